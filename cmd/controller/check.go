@@ -0,0 +1,64 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	metal3imageprovider "github.com/metal3-io/baremetal-operator/pkg/imageprovider"
+	"github.com/openshift/image-customization-controller/pkg/env"
+	"github.com/openshift/image-customization-controller/pkg/ignition"
+	"github.com/openshift/image-customization-controller/pkg/imagehandler"
+	"github.com/openshift/image-customization-controller/pkg/imageprovider"
+)
+
+// runChecks verifies that the controller could build images: that the base
+// images can be read, that nmstatectl can be run and that an ignition config
+// can be rendered for a sample host. It is a preflight check for use in e.g.
+// init containers, and starts neither the manager nor any server.
+func runChecks(ctx context.Context, imageServer imagehandler.ImageHandler, envInputs *env.EnvInputs) error {
+	if err := imageServer.CheckBaseImages(); err != nil {
+		return fmt.Errorf("base images are not available: %w", err)
+	}
+
+	nmstatectlVersion, err := ignition.CheckNMStatectl()
+	if err != nil {
+		return err
+	}
+	setupLog.Info("found nmstatectl", "version", nmstatectlVersion)
+
+	imgProvider, err := imageprovider.NewRHCOSImageProvider(ctx, imageServer, envInputs)
+	if err != nil {
+		return fmt.Errorf("cannot create image provider: %w", err)
+	}
+	renderer, ok := imgProvider.(imageprovider.IgnitionRenderer)
+	if !ok {
+		return errors.New("image provider cannot render ignition")
+	}
+	data := metal3imageprovider.ImageData{
+		ImageMetadata: &metav1.ObjectMeta{
+			Name:      "preflight-check",
+			Namespace: "default",
+		},
+	}
+	if _, err := renderer.RenderIgnition(data, nil); err != nil {
+		return fmt.Errorf("cannot render a sample ignition config: %w", err)
+	}
+	return nil
+}
@@ -17,15 +17,20 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"k8s.io/apimachinery/pkg/labels"
 	k8sruntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -38,8 +43,10 @@ import (
 	metal3iocontroller "github.com/metal3-io/baremetal-operator/controllers/metal3.io"
 	"github.com/metal3-io/baremetal-operator/pkg/secretutils"
 	"github.com/openshift/image-customization-controller/pkg/env"
+	"github.com/openshift/image-customization-controller/pkg/ignition"
 	"github.com/openshift/image-customization-controller/pkg/imagehandler"
 	"github.com/openshift/image-customization-controller/pkg/imageprovider"
+	"github.com/openshift/image-customization-controller/pkg/logging"
 	"github.com/openshift/image-customization-controller/pkg/version"
 	// +kubebuilder:scaffold:imports
 )
@@ -60,8 +67,13 @@ func init() {
 	// +kubebuilder:scaffold:scheme
 }
 
-func setupChecks(mgr ctrl.Manager) error {
-	if err := mgr.AddReadyzCheck("ping", healthz.Ping); err != nil {
+func setupChecks(mgr ctrl.Manager, imageServer imagehandler.ImageHandler) error {
+	// Readiness also requires the base images to be readable, so that a
+	// broken mount of their volume is noticed.
+	baseImagesCheck := func(_ *http.Request) error {
+		return imageServer.CheckBaseImages()
+	}
+	if err := mgr.AddReadyzCheck("base-images", baseImagesCheck); err != nil {
 		setupLog.Error(err, "unable to create ready check")
 		return err
 	}
@@ -70,42 +82,93 @@ func setupChecks(mgr ctrl.Manager) error {
 		setupLog.Error(err, "unable to create health check")
 		return err
 	}
+
+	// Liveness fails if serving images has deadlocked, so that the pod is
+	// restarted.
+	imagesCheck := func(_ *http.Request) error {
+		return imageServer.CheckResponsive()
+	}
+	if err := mgr.AddHealthzCheck("images", imagesCheck); err != nil {
+		setupLog.Error(err, "unable to create health check")
+		return err
+	}
 	return nil
 }
 
-func runController(watchNamespace string, imageServer imagehandler.ImageHandler, envInputs *env.EnvInputs, metricsBindAddr string) error {
+// parseNamespaces parses a comma-separated list of namespaces to watch. An
+// empty list means all namespaces.
+func parseNamespaces(namespaces string) ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, ns := range strings.Split(namespaces, ",") {
+		ns = strings.TrimSpace(ns)
+		if ns == "" || seen[ns] {
+			continue
+		}
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid namespace %q: %s", ns, strings.Join(errs, "; "))
+		}
+		seen[ns] = true
+		result = append(result, ns)
+	}
+	return result, nil
+}
+
+// newCacheOptions returns the options of the manager's cache, restricted to
+// the given namespaces unless there are none. Only PreprovisioningImages
+// matching labelSelector, if it is not empty, are cached and so reconciled.
+func newCacheOptions(watchNamespaces []string, labelSelector string) (cache.Options, error) {
 	excludeInfraEnv, err := labels.NewRequirement(infraEnvLabel, selection.DoesNotExist, nil)
 	if err != nil {
-		setupLog.Error(err, "cannot create an infraenv label filter")
-		return err
+		return cache.Options{}, fmt.Errorf("cannot create an infraenv label filter: %w", err)
+	}
+
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return cache.Options{}, fmt.Errorf("invalid label selector %q: %w", labelSelector, err)
 	}
+	requirements, _ := selector.Requirements()
 
-	cacheOptions := cache.Options{
+	return cache.Options{
+		Namespaces: watchNamespaces,
 		ByObject: secretutils.AddSecretSelector(map[client.Object]cache.ByObject{
 			&metal3iov1alpha1.PreprovisioningImage{}: {
-				Label: labels.NewSelector().Add(*excludeInfraEnv),
+				Label: labels.NewSelector().Add(*excludeInfraEnv).Add(requirements...),
 			},
 		}),
+	}, nil
+}
+
+func runController(ctx context.Context, watchNamespaces []string, labelSelector string, imageServer imagehandler.ImageHandler, envInputs *env.EnvInputs, metricsBindAddr, pprofBindAddr string, adminMux *http.ServeMux, debugIgnition bool) error {
+	cacheOptions, err := newCacheOptions(watchNamespaces, labelSelector)
+	if err != nil {
+		setupLog.Error(err, "unable to configure the cache")
+		return err
 	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		Port:               0, // Add flag with default of 9443 when adding webhooks
-		Namespace:          watchNamespace,
 		Cache:              cacheOptions,
 		MetricsBindAddress: metricsBindAddr,
+		PprofBindAddress:   pprofBindAddr,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		return err
 	}
 
+	imgProvider, err := imageprovider.NewRHCOSImageProvider(ctx, imageServer, envInputs)
+	if err != nil {
+		setupLog.Error(err, "unable to create image provider")
+		return err
+	}
 	imgReconciler := metal3iocontroller.PreprovisioningImageReconciler{
 		Client:        mgr.GetClient(),
 		Log:           ctrl.Log.WithName("controllers").WithName("PreprovisioningImage"),
 		APIReader:     mgr.GetAPIReader(),
 		Scheme:        mgr.GetScheme(),
-		ImageProvider: imageprovider.NewRHCOSImageProvider(imageServer, envInputs),
+		ImageProvider: imgProvider,
 	}
 	if err = (&imgReconciler).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PreprovisioningImage")
@@ -114,36 +177,139 @@ func runController(watchNamespace string, imageServer imagehandler.ImageHandler,
 
 	// +kubebuilder:scaffold:builder
 
-	if err := setupChecks(mgr); err != nil {
+	// The ignition includes secrets, so it is only served on the admin
+	// listener.
+	if renderer, ok := imgProvider.(imageprovider.IgnitionRenderer); ok && debugIgnition {
+		adminMux.Handle("/debug/ignition/", imageprovider.DebugIgnitionHandler(renderer, mgr.GetAPIReader()))
+	}
+
+	if err := setupChecks(mgr, imageServer); err != nil {
 		return err
 	}
 
 	setupLog.Info("starting manager")
-	return mgr.Start(ctrl.SetupSignalHandler())
+	return mgr.Start(ctx)
+}
+
+// startAdminServer serves the administrative endpoints on a listener of their
+// own, normally bound to the loopback interface, so that they cannot be
+// reached by everything that can download images. It stops when ctx is done.
+func startAdminServer(ctx context.Context, addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			setupLog.Error(err, "admin server failed")
+			os.Exit(1)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+}
+
+// parsePublishNetworks parses a comma-separated list of network=address pairs
+// into the publish URL of each network, resolving their hostnames if
+// requested.
+func parsePublishNetworks(networks string, resolve bool) (map[string]*url.URL, error) {
+	result := map[string]*url.URL{}
+	for _, entry := range strings.Split(networks, ",") {
+		if entry == "" {
+			continue
+		}
+		network, address, found := strings.Cut(entry, "=")
+		if !found || network == "" {
+			return nil, fmt.Errorf("invalid publish network %q, expected network=address", entry)
+		}
+		u, err := imagehandler.ParsePublishURL(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address for publish network %s: %w", network, err)
+		}
+		if resolve {
+			if u, err = imagehandler.ResolveURLHost(u); err != nil {
+				return nil, fmt.Errorf("cannot resolve address for publish network %s: %w", network, err)
+			}
+		}
+		result[network] = u
+	}
+	return result, nil
 }
 
 func main() {
 	var watchNamespace string
+	var labelSelector string
 	var metricsBindAddr string
+	var pprofBindAddr string
+	var adminBindAddr string
 	var devLogging bool
+	var logFormat string
 	var imagesBindAddr string
 	var imagesPublishAddr string
+	var imagesPublishResolve bool
+	var debugIgnition bool
+	var check bool
+	var imagesDrainTimeout time.Duration
+	var imagesMaxConcurrent int
+	var imagesReadTimeout time.Duration
+	var imagesWriteTimeout time.Duration
+	var imagesIdleTimeout time.Duration
+	var imagesPublishNetworks string
 
 	// From CAPI point of view, BMO should be able to watch all namespaces
 	// in case of a deployment that is not multi-tenant. If the deployment
 	// is for multi-tenancy, then the BMO should watch only the provided
-	// namespace.
+	// namespaces.
 	flag.StringVar(&watchNamespace, "namespace", os.Getenv("WATCH_NAMESPACE"),
-		"Namespace that the controller watches to reconcile preprovisioningimage resources.")
+		"Comma-separated list of namespaces that the controller watches to reconcile preprovisioningimage resources.")
+	flag.StringVar(&labelSelector, "label-selector", "",
+		"Label selector that preprovisioningimage resources must match to be reconciled.")
 	flag.StringVar(&metricsBindAddr, "metrics-addr", "",
 		"The address the metric endpoint binds to.")
+	flag.StringVar(&pprofBindAddr, "pprof-addr", "",
+		"The address the pprof endpoint binds to, if profiling is enabled.")
+	flag.BoolVar(&devLogging, "dev-logging", false,
+		"Log in development mode, with console output unless a log format is given.")
+	flag.StringVar(&logFormat, "log-format", "",
+		"The format of the logs, json or console (defaults to console in development mode, json otherwise).")
+	flag.StringVar(&adminBindAddr, "admin-addr", "127.0.0.1:8085",
+		"The address the administrative endpoints, such as maintenance mode, bind to; empty to disable them.")
 	flag.StringVar(&imagesBindAddr, "images-bind-addr", ":8084",
 		"The address the images endpoint binds to.")
 	flag.StringVar(&imagesPublishAddr, "images-publish-addr", "http://127.0.0.1:8084",
 		"The address clients would access the images endpoint from.")
+	flag.BoolVar(&imagesPublishResolve, "images-publish-resolve", false,
+		"Resolve the hostname in the images publish address to an IP address at startup.")
+	flag.StringVar(&imagesPublishNetworks, "images-publish-networks", "",
+		"Comma-separated list of network=address pairs giving the address clients on each network would access the images endpoint from.")
+	flag.IntVar(&imagesMaxConcurrent, "images-max-concurrent", 100,
+		"The maximum number of image requests served at once; 0 for no limit.")
+	flag.DurationVar(&imagesReadTimeout, "images-read-timeout", 30*time.Second,
+		"How long the images endpoint waits to read a request; 0 for no limit.")
+	// Writing a response includes streaming the whole image, which may take a
+	// long time for a multi-GB ISO over a slow BMC connection.
+	flag.DurationVar(&imagesWriteTimeout, "images-write-timeout", time.Hour,
+		"How long the images endpoint may take to write a response, including the image; 0 for no limit.")
+	flag.DurationVar(&imagesIdleTimeout, "images-idle-timeout", 30*time.Second,
+		"How long the images endpoint keeps idle connections open.")
+	flag.DurationVar(&imagesDrainTimeout, "images-drain-timeout", time.Minute,
+		"How long to wait on shutdown for image downloads in progress to finish.")
+	flag.BoolVar(&debugIgnition, "debug-ignition", false,
+		"Serve the ignition config for each host at /debug/ignition/<namespace>/<name> on the admin listener.")
+	flag.BoolVar(&check, "check", false,
+		"Check that the environment and base images are valid and that an ignition config can be rendered, then exit.")
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseDevMode(devLogging)))
+	logOpts, err := logging.Options(devLogging, logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ctrl.SetLogger(zap.New(logOpts...))
 
 	version.Print(setupLog)
 
@@ -153,11 +319,36 @@ func main() {
 		os.Exit(1)
 	}
 
-	publishURL, err := url.Parse(imagesPublishAddr)
+	publishURL, err := imagehandler.ParsePublishURL(imagesPublishAddr)
 	if err != nil {
-		setupLog.Error(err, "imagesPublishAddr is not parsable")
+		setupLog.Error(err, "imagesPublishAddr is not valid")
 		os.Exit(1)
 	}
+	if imagesPublishResolve {
+		publishURL, err = imagehandler.ResolveURLHost(publishURL)
+		if err != nil {
+			setupLog.Error(err, "imagesPublishAddr hostname cannot be resolved")
+			os.Exit(1)
+		}
+	}
+
+	watchNamespaces, err := parseNamespaces(watchNamespace)
+	if err != nil {
+		setupLog.Error(err, "namespace is not valid")
+		os.Exit(1)
+	}
+
+	networkURLs, err := parsePublishNetworks(imagesPublishNetworks, imagesPublishResolve)
+	if err != nil {
+		setupLog.Error(err, "imagesPublishNetworks is not valid")
+		os.Exit(1)
+	}
+
+	if nmstatectlVersion, err := ignition.CheckNMStatectl(); err != nil {
+		setupLog.Error(err, "nmstatectl is not available, images cannot be built for hosts with network data")
+	} else {
+		setupLog.Info("found nmstatectl", "version", nmstatectlVersion)
+	}
 
 	// If not defined via env var, look for the mounted secret file
 	if envInputs.IronicAgentPullSecret == "" {
@@ -169,25 +360,72 @@ func main() {
 		envInputs.IronicAgentPullSecret = string(pullSecretRaw)
 	}
 
-	imageServer := imagehandler.NewImageHandler(ctrl.Log.WithName("ImageHandler"), envInputs.DeployISO, envInputs.DeployInitrd, publishURL)
-	http.Handle("/", http.FileServer(imageServer.FileSystem()))
+	imageServer, err := imagehandler.NewImageHandler(ctrl.Log.WithName("ImageHandler"), publishURL, networkURLs, envInputs)
+	if err != nil {
+		setupLog.Error(err, "unable to load base images")
+		os.Exit(1)
+	}
 
-	go func() {
-		server := &http.Server{
-			Addr:              imagesBindAddr,
-			ReadHeaderTimeout: 5 * time.Second,
+	if check {
+		if err := runChecks(context.Background(), imageServer, envInputs); err != nil {
+			setupLog.Error(err, "check failed")
+			os.Exit(1)
 		}
+		setupLog.Info("all checks passed")
+		os.Exit(0)
+	}
+
+	http.Handle("/", imagehandler.LimitConcurrency(imageServer.Handler(), imagesMaxConcurrent))
+	http.Handle("/images/info", imageServer.InfoHandler())
+	http.Handle("/version", version.Handler())
+	http.Handle("/metrics", imagehandler.MetricsHandler())
 
+	ctx := ctrl.SetupSignalHandler()
+
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/maintenance", imageServer.MaintenanceHandler())
+	adminMux.Handle("/config", envInputs.ConfigHandler())
+	if adminBindAddr != "" {
+		startAdminServer(ctx, adminBindAddr, adminMux)
+	} else if debugIgnition {
+		setupLog.Info("-debug-ignition has no effect without -admin-addr")
+	}
+
+	server := &http.Server{
+		Addr:              imagesBindAddr,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       imagesReadTimeout,
+		WriteTimeout:      imagesWriteTimeout,
+		IdleTimeout:       imagesIdleTimeout,
+	}
+
+	go func() {
 		err := server.ListenAndServe()
 
-		if err != nil {
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			setupLog.Error(err, "")
 			os.Exit(1)
 		}
 	}()
 
-	if err := runController(watchNamespace, imageServer, envInputs, metricsBindAddr); err != nil {
+	// On shutdown, stop accepting new requests but let image downloads in
+	// progress finish, up to the drain timeout.
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		<-ctx.Done()
+
+		setupLog.Info("shutting down images server", "timeout", imagesDrainTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), imagesDrainTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			setupLog.Error(err, "images server did not shut down cleanly")
+		}
+	}()
+
+	if err := runController(ctx, watchNamespaces, labelSelector, imageServer, envInputs, metricsBindAddr, pprofBindAddr, adminMux, debugIgnition); err != nil {
 		setupLog.Error(err, "problem running controller")
 		os.Exit(1)
 	}
+	<-serverDone
 }
@@ -0,0 +1,271 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	metal3iov1alpha1 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+	"github.com/openshift/image-customization-controller/pkg/env"
+	"github.com/openshift/image-customization-controller/pkg/imagehandler"
+)
+
+func TestParseNamespaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "all",
+			want: []string{},
+		},
+		{
+			name:  "single",
+			value: "openshift-machine-api",
+			want:  []string{"openshift-machine-api"},
+		},
+		{
+			name:  "multiple",
+			value: "tenant-a, tenant-b,,tenant-a",
+			want:  []string{"tenant-a", "tenant-b"},
+		},
+		{
+			name:    "invalid",
+			value:   "tenant-a,Tenant_B",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNamespaces(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected namespaces %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCacheOptions(t *testing.T) {
+	namespaces := []string{"tenant-a", "tenant-b"}
+	opts, err := newCacheOptions(namespaces, "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(opts.Namespaces, namespaces) {
+		t.Errorf("unexpected cache namespaces %v", opts.Namespaces)
+	}
+	var selector labels.Selector
+	for obj, byObject := range opts.ByObject {
+		if _, ok := obj.(*metal3iov1alpha1.PreprovisioningImage); ok {
+			selector = byObject.Label
+		}
+	}
+	if selector == nil {
+		t.Fatal("no label selector for PreprovisioningImages")
+	}
+	// Images of InfraEnvs are built by the assisted installer, so they are
+	// never reconciled here.
+	if !selector.Matches(labels.Set{}) {
+		t.Error("unlabeled PreprovisioningImage not reconciled")
+	}
+	if !selector.Matches(labels.Set{"tenant": "a"}) {
+		t.Error("PreprovisioningImage with other labels not reconciled")
+	}
+	if selector.Matches(labels.Set{infraEnvLabel: "myenv"}) {
+		t.Error("InfraEnv PreprovisioningImage reconciled")
+	}
+
+	opts, err = newCacheOptions(nil, "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(opts.Namespaces) != 0 {
+		t.Errorf("unexpected cache namespaces %v", opts.Namespaces)
+	}
+}
+
+func TestNewCacheOptionsLabelSelector(t *testing.T) {
+	opts, err := newCacheOptions(nil, "tenant=a")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var selector labels.Selector
+	for obj, byObject := range opts.ByObject {
+		if _, ok := obj.(*metal3iov1alpha1.PreprovisioningImage); ok {
+			selector = byObject.Label
+		}
+	}
+	if selector == nil {
+		t.Fatal("no label selector for PreprovisioningImages")
+	}
+
+	for _, tt := range []struct {
+		labels labels.Set
+		want   bool
+	}{
+		{labels: labels.Set{"tenant": "a"}, want: true},
+		{labels: labels.Set{"tenant": "b"}},
+		{labels: labels.Set{}},
+		{labels: labels.Set{"tenant": "a", infraEnvLabel: "myenv"}},
+	} {
+		if got := selector.Matches(tt.labels); got != tt.want {
+			t.Errorf("selector match of %v is %v, want %v", tt.labels, got, tt.want)
+		}
+	}
+
+	if _, err := newCacheOptions(nil, "tenant in (a"); err == nil {
+		t.Error("expected an error for an invalid label selector")
+	}
+}
+
+type fakeImageHandler struct {
+	baseImagesErr error
+}
+
+var _ imagehandler.ImageHandler = &fakeImageHandler{}
+
+func (f *fakeImageHandler) FileSystem() http.FileSystem { return nil }
+func (f *fakeImageHandler) Handler() http.Handler       { return nil }
+func (f *fakeImageHandler) ServeImage(key, arch, version, network string, ignitionContent []byte, kargs []string, initramfs, static bool) (string, error) {
+	return "", nil
+}
+func (f *fakeImageHandler) RemoveImage(key string)                    {}
+func (f *fakeImageHandler) HasImagesForArchitecture(arch string) bool { return true }
+func (f *fakeImageHandler) MaintenanceHandler() http.Handler          { return nil }
+func (f *fakeImageHandler) InfoHandler() http.Handler                 { return nil }
+func (f *fakeImageHandler) CheckBaseImages() error                    { return f.baseImagesErr }
+func (f *fakeImageHandler) CheckResponsive() error                    { return nil }
+
+func TestRunChecks(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho nmstatectl 2.2.15\n"
+	if err := os.WriteFile(filepath.Join(dir, "nmstatectl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	validEnv := func() *env.EnvInputs {
+		return &env.EnvInputs{
+			IronicBaseURL:     "http://ironic.example.com",
+			IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+			InsecureIronicTLS: true,
+		}
+	}
+	tests := []struct {
+		name      string
+		path      string
+		handler   *fakeImageHandler
+		envInputs *env.EnvInputs
+		wantErr   string
+	}{
+		{
+			name:      "ok",
+			path:      dir,
+			handler:   &fakeImageHandler{},
+			envInputs: validEnv(),
+		},
+		{
+			name:      "no base images",
+			path:      dir,
+			handler:   &fakeImageHandler{baseImagesErr: errors.New("no base images found")},
+			envInputs: validEnv(),
+			wantErr:   "base images",
+		},
+		{
+			name:      "no nmstatectl",
+			path:      t.TempDir(),
+			handler:   &fakeImageHandler{},
+			envInputs: validEnv(),
+			wantErr:   "nmstatectl",
+		},
+		{
+			name:    "invalid config",
+			path:    dir,
+			handler: &fakeImageHandler{},
+			envInputs: &env.EnvInputs{
+				IronicBaseURL:     "http://ironic.example.com",
+				IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+				InsecureIronicTLS: false,
+			},
+			wantErr: "render",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PATH", tt.path)
+			err := runChecks(context.Background(), tt.handler, tt.envInputs)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRunChecksImageHandler(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho nmstatectl 2.2.15\n"
+	if err := os.WriteFile(filepath.Join(dir, "nmstatectl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	for _, name := range []string{"ironic-python-agent.iso", "ironic-python-agent.initramfs"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	envInputs := &env.EnvInputs{
+		DeployISO:         filepath.Join(dir, "ironic-python-agent.iso"),
+		DeployInitrd:      filepath.Join(dir, "ironic-python-agent.initramfs"),
+		IronicBaseURL:     "http://ironic.example.com",
+		IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+		InsecureIronicTLS: true,
+	}
+	publishURL, _ := url.Parse("http://images.example.com")
+	imageServer, err := imagehandler.NewImageHandler(zap.New(zap.UseDevMode(true)), publishURL, nil, envInputs)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := runChecks(context.Background(), imageServer, envInputs); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
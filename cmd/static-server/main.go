@@ -16,9 +16,9 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/fs"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"strings"
@@ -32,6 +32,7 @@ import (
 	"github.com/openshift/image-customization-controller/pkg/env"
 	"github.com/openshift/image-customization-controller/pkg/ignition"
 	"github.com/openshift/image-customization-controller/pkg/imagehandler"
+	"github.com/openshift/image-customization-controller/pkg/logging"
 	"github.com/openshift/image-customization-controller/pkg/version"
 	// +kubebuilder:scaffold:imports
 )
@@ -41,11 +42,6 @@ var (
 )
 
 func loadStaticNMState(fsys fs.FS, env *env.EnvInputs, nmstateDir string, imageServer imagehandler.ImageHandler) error {
-	registries, err := env.RegistriesConf()
-	if err != nil {
-		return err
-	}
-
 	// If not defined via env var, look for the mounted secret file
 	pullSecret := env.IronicAgentPullSecret
 	if env.IronicAgentPullSecret == "" {
@@ -56,17 +52,22 @@ func loadStaticNMState(fsys fs.FS, env *env.EnvInputs, nmstateDir string, imageS
 		pullSecret = string(pullSecretRaw)
 	}
 
+	template, err := ignition.NewTemplate(env, pullSecret)
+	if err != nil {
+		return errors.WithMessage(err, "failed to configure ignition")
+	}
+
+	kargs, err := imagehandler.ParseSerialConsole(env.SerialConsole)
+	if err != nil {
+		return err
+	}
+
 	nmstateDir = strings.Trim(nmstateDir, "/")
 	files, err := fs.ReadDir(fsys, nmstateDir)
 	if err != nil {
 		return errors.WithMessagef(err, "problem reading %s", nmstateDir)
 	}
 
-	additionalNTPServers := []string{}
-	if env.AdditionalNTPServers != "" {
-		additionalNTPServers = strings.Split(env.AdditionalNTPServers, ",")
-	}
-
 	for _, f := range files {
 		if f.IsDir() {
 			continue
@@ -76,20 +77,7 @@ func loadStaticNMState(fsys fs.FS, env *env.EnvInputs, nmstateDir string, imageS
 			return errors.WithMessagef(err, "problem reading %s", path.Join(nmstateDir, f.Name()))
 		}
 		hostname := strings.TrimSuffix(f.Name(), path.Ext(f.Name()))
-		igBuilder, err := ignition.New(b, registries,
-			env.IronicBaseURL,
-			env.IronicInspectorBaseURL,
-			env.IronicAgentImage,
-			pullSecret,
-			env.IronicRAMDiskSSHKey,
-			env.IpOptions,
-			env.HttpProxy,
-			env.HttpsProxy,
-			env.NoProxy,
-			hostname,
-			env.IronicAgentVlanInterfaces,
-			additionalNTPServers,
-		)
+		igBuilder, err := template.Builder(b, hostname, "")
 		if err != nil {
 			return errors.WithMessage(err, "failed to configure ignition")
 		}
@@ -105,7 +93,7 @@ func loadStaticNMState(fsys fs.FS, env *env.EnvInputs, nmstateDir string, imageS
 			imageName := strings.TrimSuffix(f.Name(), ".yaml") + suffix
 
 			isInitramfs := !strings.HasSuffix(imageName, ".iso")
-			url, err := imageServer.ServeImage(imageName, ign, isInitramfs, true)
+			url, err := imageServer.ServeImage(imageName, "", "", "", ign, kargs, isInitramfs, true)
 			if err != nil {
 				return err
 			}
@@ -117,19 +105,46 @@ func loadStaticNMState(fsys fs.FS, env *env.EnvInputs, nmstateDir string, imageS
 
 func main() {
 	var devLogging bool
+	var logFormat string
 	var imagesBindAddr string
 	var imagesPublishAddr string
+	var imagesPublishResolve bool
+	var imagesMaxConcurrent int
+	var imagesReadTimeout time.Duration
+	var imagesWriteTimeout time.Duration
+	var imagesIdleTimeout time.Duration
 	var nmstateDir string
 
+	flag.BoolVar(&devLogging, "dev-logging", false,
+		"Log in development mode, with console output unless a log format is given.")
+	flag.StringVar(&logFormat, "log-format", "",
+		"The format of the logs, json or console (defaults to console in development mode, json otherwise).")
 	flag.StringVar(&imagesBindAddr, "images-bind-addr", ":8084",
 		"The address the images endpoint binds to.")
 	flag.StringVar(&imagesPublishAddr, "images-publish-addr", "http://127.0.0.1:8084",
 		"The address clients would access the images endpoint from.")
+	flag.BoolVar(&imagesPublishResolve, "images-publish-resolve", false,
+		"Resolve the hostname in the images publish address to an IP address at startup.")
+	flag.IntVar(&imagesMaxConcurrent, "images-max-concurrent", 100,
+		"The maximum number of image requests served at once; 0 for no limit.")
+	flag.DurationVar(&imagesReadTimeout, "images-read-timeout", 30*time.Second,
+		"How long the images endpoint waits to read a request; 0 for no limit.")
+	// Writing a response includes streaming the whole image, which may take a
+	// long time for a multi-GB ISO over a slow BMC connection.
+	flag.DurationVar(&imagesWriteTimeout, "images-write-timeout", time.Hour,
+		"How long the images endpoint may take to write a response, including the image; 0 for no limit.")
+	flag.DurationVar(&imagesIdleTimeout, "images-idle-timeout", 30*time.Second,
+		"How long the images endpoint keeps idle connections open.")
 	flag.StringVar(&nmstateDir, "nmstate-dir", "",
 		"location of static nmstate files (named with the target image - master-0.yaml).")
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseDevMode(devLogging)))
+	logOpts, err := logging.Options(devLogging, logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ctrl.SetLogger(zap.New(logOpts...))
 
 	version.Print(log)
 
@@ -139,19 +154,33 @@ func main() {
 		os.Exit(1)
 	}
 
-	publishURL, err := url.Parse(imagesPublishAddr)
+	publishURL, err := imagehandler.ParsePublishURL(imagesPublishAddr)
 	if err != nil {
-		log.Error(err, "imagesPublishAddr is not parsable")
+		log.Error(err, "imagesPublishAddr is not valid")
 		os.Exit(1)
 	}
+	if imagesPublishResolve {
+		publishURL, err = imagehandler.ResolveURLHost(publishURL)
+		if err != nil {
+			log.Error(err, "imagesPublishAddr hostname cannot be resolved")
+			os.Exit(1)
+		}
+	}
 
 	if nmstateDir == "" {
 		log.Info("no nmstate-dir provided")
 		os.Exit(1)
 	}
 
-	imageServer := imagehandler.NewImageHandler(ctrl.Log.WithName("ImageHandler"), env.DeployISO, env.DeployInitrd, publishURL)
-	http.Handle("/", http.FileServer(imageServer.FileSystem()))
+	imageServer, err := imagehandler.NewImageHandler(ctrl.Log.WithName("ImageHandler"), publishURL, nil, env)
+	if err != nil {
+		log.Error(err, "unable to load base images")
+		os.Exit(1)
+	}
+	http.Handle("/", imagehandler.LimitConcurrency(imageServer.Handler(), imagesMaxConcurrent))
+	http.Handle("/images/info", imageServer.InfoHandler())
+	http.Handle("/version", version.Handler())
+	http.Handle("/metrics", imagehandler.MetricsHandler())
 
 	if err := loadStaticNMState(os.DirFS("/"), env, nmstateDir, imageServer); err != nil {
 		log.Error(err, "problem loading static ignitions")
@@ -161,6 +190,9 @@ func main() {
 	server := http.Server{
 		Addr:              imagesBindAddr,
 		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       imagesReadTimeout,
+		WriteTimeout:      imagesWriteTimeout,
+		IdleTimeout:       imagesIdleTimeout,
 	}
 
 	err2 := server.ListenAndServe()
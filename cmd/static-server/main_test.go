@@ -42,18 +42,25 @@ func (f *fakeImageFileSystem) Seek(offset int64, whence int) (int64, error) { re
 func (f *fakeImageFileSystem) Readdir(n int) ([]fs.FileInfo, error)         { return nil, nil }
 func (f *fakeImageFileSystem) Open(name string) (http.File, error)          { return nil, nil }
 func (f *fakeImageFileSystem) FileSystem() http.FileSystem                  { return f }
-func (f *fakeImageFileSystem) ServeImage(name string, ignitionContent []byte, initrd, static bool) (string, error) {
+func (f *fakeImageFileSystem) Handler() http.Handler                        { return nil }
+func (f *fakeImageFileSystem) ServeImage(name, arch, version, network string, ignitionContent []byte, kargs []string, initrd, static bool) (string, error) {
 	f.imagesServed = append(f.imagesServed, name)
 	return "", nil
 }
-func (f *fakeImageFileSystem) RemoveImage(name string) {}
+func (f *fakeImageFileSystem) RemoveImage(name string)                   {}
+func (f *fakeImageFileSystem) HasImagesForArchitecture(arch string) bool { return true }
+func (f *fakeImageFileSystem) MaintenanceHandler() http.Handler          { return nil }
+func (f *fakeImageFileSystem) InfoHandler() http.Handler                 { return nil }
+func (f *fakeImageFileSystem) CheckBaseImages() error                    { return nil }
+func (f *fakeImageFileSystem) CheckResponsive() error                    { return nil }
 
 func TestLoadStaticNMState(t *testing.T) {
 	fifs := &fakeImageFileSystem{imagesServed: []string{}}
 	env := &env.EnvInputs{
-		DeployISO:        "foo.iso",
-		IronicBaseURL:    "http://example.com",
-		IronicAgentImage: "quay.io/tantsur/ironic-agent",
+		DeployISO:         "foo.iso",
+		IronicBaseURL:     "http://example.com",
+		IronicAgentImage:  "quay.io/tantsur/ironic-agent",
+		InsecureIronicTLS: true,
 	}
 
 	fs := fstest.MapFS{
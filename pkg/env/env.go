@@ -1,27 +1,77 @@
 package env
 
 import (
+	"net/url"
 	"os"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
 )
 
 type EnvInputs struct {
-	DeployISO                 string `envconfig:"DEPLOY_ISO" required:"true"`
-	DeployInitrd              string `envconfig:"DEPLOY_INITRD" required:"true"`
-	IronicBaseURL             string `envconfig:"IRONIC_BASE_URL"`
-	IronicInspectorBaseURL    string `envconfig:"IRONIC_INSPECTOR_BASE_URL"`
-	IronicAgentImage          string `envconfig:"IRONIC_AGENT_IMAGE" required:"true"`
-	IronicAgentPullSecret     string `envconfig:"IRONIC_AGENT_PULL_SECRET"`
-	IronicAgentVlanInterfaces string `envconfig:"IRONIC_AGENT_VLAN_INTERFACES"`
-	IronicRAMDiskSSHKey       string `envconfig:"IRONIC_RAMDISK_SSH_KEY"`
-	RegistriesConfPath        string `envconfig:"REGISTRIES_CONF_PATH"`
-	IpOptions                 string `envconfig:"IP_OPTIONS"`
-	HttpProxy                 string `envconfig:"HTTP_PROXY"`
-	HttpsProxy                string `envconfig:"HTTPS_PROXY"`
-	NoProxy                   string `envconfig:"NO_PROXY"`
-	AdditionalNTPServers      string `envconfig:"ADDITIONAL_NTP_SERVERS"`
+	DeployISO                 string            `envconfig:"DEPLOY_ISO" required:"true"`
+	DeployInitrd              string            `envconfig:"DEPLOY_INITRD" required:"true"`
+	ImageSharedDir            string            `envconfig:"IMAGE_SHARED_DIR"`
+	IronicBaseURL             string            `envconfig:"IRONIC_BASE_URL"`
+	IronicInspectorBaseURL    string            `envconfig:"IRONIC_INSPECTOR_BASE_URL"`
+	IronicAgentImage          string            `envconfig:"IRONIC_AGENT_IMAGE" required:"true"`
+	IronicAgentPullSecret     string            `envconfig:"IRONIC_AGENT_PULL_SECRET"`
+	IronicAgentTLSVerify      bool              `envconfig:"IRONIC_AGENT_TLS_VERIFY"`
+	IronicAgentVlanInterfaces string            `envconfig:"IRONIC_AGENT_VLAN_INTERFACES"`
+	IronicAgentStartTimeout   time.Duration     `envconfig:"IRONIC_AGENT_START_TIMEOUT"`
+	IronicAgentStartTimeouts  string            `envconfig:"IRONIC_AGENT_START_TIMEOUTS"`
+	AgentReregister           bool              `envconfig:"IRONIC_AGENT_REREGISTER"`
+	ReregisterInterval        time.Duration     `envconfig:"IRONIC_AGENT_REREGISTER_INTERVAL" default:"1h"`
+	IronicAgentRestartPolicy  string            `envconfig:"IRONIC_AGENT_RESTART_POLICY"`
+	IronicAgentContainerName  string            `envconfig:"IRONIC_AGENT_CONTAINER_NAME"`
+	IronicAgentExtraMounts    []string          `envconfig:"IRONIC_AGENT_EXTRA_MOUNTS"`
+	IronicAgentExtraEnv       map[string]string `envconfig:"IRONIC_AGENT_EXTRA_ENV"`
+	DefaultEnv                map[string]string `envconfig:"DEFAULT_ENVIRONMENT"`
+	InspectionBenchmarks      string            `envconfig:"IRONIC_INSPECTION_BENCHMARKS"`
+	InspectionDHCPAll         string            `envconfig:"IRONIC_INSPECTION_DHCP_ALL_INTERFACES"`
+	CollectLLDP               string            `envconfig:"IRONIC_COLLECT_LLDP"`
+	IronicRAMDiskSSHKey       string            `envconfig:"IRONIC_RAMDISK_SSH_KEY"`
+	RAMDiskPasswordLogin      bool              `envconfig:"IRONIC_RAMDISK_PASSWORD_LOGIN"`
+	RAMDiskPasswordHash       string            `envconfig:"IRONIC_RAMDISK_PASSWORD_HASH"`
+	InsecureIronicTLS         bool              `envconfig:"IRONIC_INSECURE" default:"true"`
+	IronicCACertPath          string            `envconfig:"IRONIC_CACERT_FILE"`
+	IronicClientCertPath      string            `envconfig:"IRONIC_CLIENT_CERT_FILE"`
+	IronicClientKeyPath       string            `envconfig:"IRONIC_CLIENT_KEY_FILE"`
+	RegistriesConfPath        string            `envconfig:"REGISTRIES_CONF_PATH"`
+	CompressRegistriesConf    bool              `envconfig:"REGISTRIES_CONF_COMPRESS"`
+	RegistriesConfTarget      string            `envconfig:"REGISTRIES_CONF_TARGET"`
+	RegistriesConfMode        string            `envconfig:"REGISTRIES_CONF_MODE"`
+	RequireRegistries         bool              `envconfig:"REGISTRIES_CONF_REQUIRED"`
+	ExtraIgnitionFilesDir     string            `envconfig:"EXTRA_IGNITION_FILES_DIR"`
+	ExtraIgnitionFilesOwner   string            `envconfig:"EXTRA_IGNITION_FILES_OWNER"`
+	IgnitionOverridesDir      string            `envconfig:"IGNITION_OVERRIDES_DIR"`
+	LoginBanner               string            `envconfig:"LOGIN_BANNER"`
+	TrustBundlePath           string            `envconfig:"TRUST_BUNDLE_PATH"`
+	IpOptions                 string            `envconfig:"IP_OPTIONS"`
+	IPStack                   string            `envconfig:"IP_STACK"`
+	DefaultIPOptions          string            `envconfig:"IP_OPTIONS_DEFAULT" default:"ip=dhcp,dhcp6"`
+	NetworkKeyFilesDir        string            `envconfig:"NETWORK_KEYFILES_DIR"`
+	NMStatectlTimeout         time.Duration     `envconfig:"NMSTATECTL_TIMEOUT" default:"15s"`
+	HttpProxy                 string            `envconfig:"HTTP_PROXY"`
+	HttpsProxy                string            `envconfig:"HTTPS_PROXY"`
+	NoProxy                   string            `envconfig:"NO_PROXY"`
+	AdditionalNTPServers      string            `envconfig:"ADDITIONAL_NTP_SERVERS"`
+	DNSServers                string            `envconfig:"DNS_SERVERS"`
+	HostnameDomain            string            `envconfig:"HOSTNAME_DOMAIN"`
+	SerialConsole             string            `envconfig:"SERIAL_CONSOLE"`
+	RemoteSyslogServer        string            `envconfig:"REMOTE_SYSLOG_SERVER"`
+	JournalStorage            string            `envconfig:"JOURNAL_STORAGE"`
+	JournalMaxUse             string            `envconfig:"JOURNAL_MAX_USE"`
+	ImageChecksumFormats      string            `envconfig:"IMAGE_CHECKSUM_FORMATS"`
+	PrecomputeChecksums       bool              `envconfig:"PRECOMPUTE_BASE_IMAGE_CHECKSUMS"`
+	StrictBaseImages          bool              `envconfig:"STRICT_BASE_IMAGES"`
+	ChecksumStaticImageNames  bool              `envconfig:"STATIC_IMAGE_NAMES_CHECKSUM"`
+	ServeCompressedISOs       bool              `envconfig:"SERVE_COMPRESSED_ISOS"`
+	ImageArchAliases          string            `envconfig:"IMAGE_ARCH_ALIASES"`
+	ImageArchPublishURLs      string            `envconfig:"IMAGE_ARCH_PUBLISH_URLS"`
+	MaxIgnitionSize           int64             `envconfig:"MAX_IGNITION_SIZE" default:"262144"`
+	RemoteIgnition            bool              `envconfig:"REMOTE_IGNITION"`
 }
 
 func New() (*EnvInputs, error) {
@@ -30,6 +80,48 @@ func New() (*EnvInputs, error) {
 	return env, err
 }
 
+const redacted = "<redacted>"
+
+// Sanitized returns a copy of the inputs that is safe to display, with
+// secrets and credentials redacted.
+func (env *EnvInputs) Sanitized() *EnvInputs {
+	sanitized := *env
+	for _, secret := range []*string{
+		&sanitized.IronicAgentPullSecret,
+		&sanitized.IronicRAMDiskSSHKey,
+		&sanitized.RAMDiskPasswordHash,
+	} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	for _, proxy := range []*string{
+		&sanitized.HttpProxy,
+		&sanitized.HttpsProxy,
+	} {
+		if u, err := url.Parse(*proxy); err == nil && u.User != nil {
+			u.User = url.User(redacted)
+			*proxy = u.String()
+		}
+	}
+	sanitized.IronicAgentExtraEnv = redactValues(sanitized.IronicAgentExtraEnv)
+	sanitized.DefaultEnv = redactValues(sanitized.DefaultEnv)
+	return &sanitized
+}
+
+// redactValues returns a copy of an environment with its values redacted, as
+// they may hold credentials, but its variable names kept.
+func redactValues(environment map[string]string) map[string]string {
+	if environment == nil {
+		return nil
+	}
+	result := make(map[string]string, len(environment))
+	for name := range environment {
+		result[name] = redacted
+	}
+	return result
+}
+
 func (env *EnvInputs) RegistriesConf() (data []byte, err error) {
 	if env.RegistriesConfPath == "" {
 		return
@@ -42,3 +134,55 @@ func (env *EnvInputs) RegistriesConf() (data []byte, err error) {
 	}
 	return
 }
+
+func (env *EnvInputs) IronicCACert() (data []byte, err error) {
+	if env.IronicCACertPath == "" {
+		return
+	}
+
+	data, err = os.ReadFile(env.IronicCACertPath)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read Ironic CA certificate file %s",
+			env.IronicCACertPath)
+	}
+	return
+}
+
+// IronicClientCert returns the certificate and private key the agent uses to
+// authenticate to Ironic, if they are configured. Either both or neither must
+// be.
+func (env *EnvInputs) IronicClientCert() (cert, key []byte, err error) {
+	if env.IronicClientCertPath == "" && env.IronicClientKeyPath == "" {
+		return
+	}
+	if env.IronicClientCertPath == "" || env.IronicClientKeyPath == "" {
+		err = errors.New("both IRONIC_CLIENT_CERT_FILE and IRONIC_CLIENT_KEY_FILE are required for a client certificate")
+		return
+	}
+
+	cert, err = os.ReadFile(env.IronicClientCertPath)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read Ironic client certificate file %s",
+			env.IronicClientCertPath)
+		return
+	}
+	key, err = os.ReadFile(env.IronicClientKeyPath)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read Ironic client key file %s",
+			env.IronicClientKeyPath)
+	}
+	return
+}
+
+func (env *EnvInputs) TrustBundle() (data []byte, err error) {
+	if env.TrustBundlePath == "" {
+		return
+	}
+
+	data, err = os.ReadFile(env.TrustBundlePath)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read trust bundle file %s",
+			env.TrustBundlePath)
+	}
+	return
+}
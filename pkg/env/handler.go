@@ -0,0 +1,21 @@
+package env
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ConfigHandler returns an http.Handler that reports the sanitized inputs as
+// JSON.
+func (env *EnvInputs) ConfigHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(env.Sanitized())
+	})
+}
@@ -1,46 +1,121 @@
 package ignition
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	ignition_config_types_32 "github.com/coreos/ignition/v2/config/v3_2/types"
-	vpath "github.com/coreos/vcontext/path"
 )
 
 const (
-	// https://github.com/openshift/ironic-image/blob/master/scripts/configure-coreos-ipa#L14
-	ironicAgentPodmanFlags = "--tls-verify=false"
+	ironicCACertPath     = "/etc/ironic-ca.crt"
+	ironicClientCertPath = "/etc/ironic-client.crt"
+	ironicClientKeyPath  = "/etc/ironic-client.key"
+
+	defaultNMStatectlTimeout = 15 * time.Second
+	defaultIPOptions         = "ip=dhcp,dhcp6"
+	trustBundlePath          = "/etc/pki/ca-trust/source/anchors/icc-ca.pem"
+	remoteSyslogPath         = "/etc/rsyslog.d/90-icc-remote.conf"
+	journaldConfPath         = "/etc/systemd/journald.conf.d/10-persistent.conf"
+	defaultRegistriesPath    = "/etc/containers/registries.conf"
+	defaultRegistriesMode    = 0644
+	// Ordered before the 40-disable-passwords.conf shipped in CoreOS, as the
+	// first value sshd reads wins.
+	sshdPasswordAuthPath = "/etc/ssh/sshd_config.d/20-icc-enable-passwords.conf"
+	dnsServersPath       = "/etc/NetworkManager/conf.d/dns-servers.conf"
+	defaultEnvPath       = "/etc/systemd/system.conf.d/10-default-env.conf"
+
+	defaultSyslogPort = "514"
 )
 
+// cryptHashRegexp matches password hashes in the crypt(3) format, e.g.
+// $6$salt$hash for SHA-512 or $y$params$salt$hash for yescrypt.
+var cryptHashRegexp = regexp.MustCompile(`^\$[0-9a-z]+\$[./0-9A-Za-z$=,]+$`)
+
 type ignitionBuilder struct {
 	nmStateData               []byte
 	registriesConf            []byte
+	compressRegistriesConf    bool
+	registriesPath            string
+	registriesMode            int
+	extraFilesDir             string
+	extraFilesOwner           fileOwner
+	overridesDir              string
+	loginBanner               string
+	journalStorage            string
+	journalMaxUse             string
 	ironicBaseURL             string
 	ironicInspectorBaseURL    string
 	ironicAgentImage          string
 	ironicAgentPullSecret     string
 	ironicRAMDiskSSHKey       string
+	ramDiskPasswordHash       string
+	ctx                       context.Context
+	verifyIronicTLS           bool
+	ironicCACert              []byte
+	ironicClientCert          []byte
+	ironicClientKey           []byte
+	trustBundle               []byte
+	inspectionBenchmarks      []string
+	inspectionDHCPAll         *bool
+	collectLLDP               *bool
+	agentImageTLSVerify       bool
+	remoteSyslog              string
+	architecture              string
+	startTimeouts             map[string]time.Duration
+	defaultStartTimeout       time.Duration
+	reregisterInterval        time.Duration
+	restartPolicy             string
+	containerName             string
+	extraMounts               []string
+	extraAgentEnv             []string
 	networkKeyFiles           []byte
+	networkStateProcessed     bool
+	nmstatectlTimeout         time.Duration
+	keyFilesDir               string
 	ipOptions                 string
+	ipStackSet                bool
+	defaultIPOptions          string
 	httpProxy                 string
 	httpsProxy                string
 	noProxy                   string
 	hostname                  string
+	hostnameDomain            string
 	ironicAgentVlanInterfaces string
 	additionalNTPServers      []string
+	dnsServers                []string
+	defaultEnv                []string
 }
 
 func New(nmStateData, registriesConf []byte, ironicBaseURL, ironicInspectorBaseURL, ironicAgentImage, ironicAgentPullSecret, ironicRAMDiskSSHKey, ipOptions string, httpProxy, httpsProxy, noProxy string, hostname string, ironicAgentVlanInterfaces string, additionalNTPServers []string) (*ignitionBuilder, error) {
 	if ironicBaseURL == "" {
 		return nil, errors.New("ironicBaseURL is required")
 	}
+	if err := validateURLs(ironicBaseURL); err != nil {
+		return nil, fmt.Errorf("invalid ironicBaseURL: %w", err)
+	}
+	if err := validateURLs(ironicInspectorBaseURL); err != nil {
+		return nil, fmt.Errorf("invalid ironicInspectorBaseURL: %w", err)
+	}
 	if ironicAgentImage == "" {
 		return nil, errors.New("ironicAgentImage is required")
 	}
+	if ironicAgentPullSecret != "" {
+		if err := validatePullSecret(ironicAgentPullSecret); err != nil {
+			return nil, err
+		}
+	}
 
 	return &ignitionBuilder{
 		nmStateData:               nmStateData,
@@ -57,39 +132,647 @@ func New(nmStateData, registriesConf []byte, ironicBaseURL, ironicInspectorBaseU
 		hostname:                  hostname,
 		ironicAgentVlanInterfaces: ironicAgentVlanInterfaces,
 		additionalNTPServers:      additionalNTPServers,
+		keyFilesDir:               defaultKeyFilesDir,
+		nmstatectlTimeout:         defaultNMStatectlTimeout,
+		defaultIPOptions:          defaultIPOptions,
+		registriesPath:            defaultRegistriesPath,
+		registriesMode:            defaultRegistriesMode,
 	}, nil
 }
 
+// SetIronicTLS configures whether the agent verifies the TLS certificate of
+// Ironic, using the given CA certificate.
+func (b *ignitionBuilder) SetIronicTLS(insecure bool, caCert []byte) {
+	b.verifyIronicTLS = !insecure
+	b.ironicCACert = caCert
+}
+
+// SetIronicClientCert sets a certificate and private key that the agent
+// presents to Ironic, for endpoints requiring TLS client authentication.
+// Either both or neither must be given.
+func (b *ignitionBuilder) SetIronicClientCert(cert, key []byte) error {
+	if (len(cert) == 0) != (len(key) == 0) {
+		return errors.New("an Ironic client certificate requires both a certificate and a key")
+	}
+	b.ironicClientCert = cert
+	b.ironicClientKey = key
+	return nil
+}
+
+// SetTrustBundle adds the given CA certificates to the trust store of the
+// agent, e.g. for a proxy that intercepts TLS connections.
+func (b *ignitionBuilder) SetTrustBundle(trustBundle []byte) {
+	b.trustBundle = trustBundle
+}
+
+// SetCompressRegistriesConf configures whether registries.conf is embedded
+// in the ignition compressed, to keep large mirror configurations within the
+// size limits of virtual media.
+func (b *ignitionBuilder) SetCompressRegistriesConf(compress bool) {
+	b.compressRegistriesConf = compress
+}
+
+// SetRegistriesPath sets where registries.conf is written. A path other than
+// the default, /etc/containers/registries.conf, is treated as a drop-in such
+// as /etc/containers/registries.conf.d/99-icc.conf, which is layered over the
+// existing configuration rather than replacing it. An empty string selects
+// the default.
+func (b *ignitionBuilder) SetRegistriesPath(registriesPath string) error {
+	if registriesPath == "" {
+		registriesPath = defaultRegistriesPath
+	}
+	if !path.IsAbs(registriesPath) {
+		return fmt.Errorf("registries.conf path %q is not an absolute path", registriesPath)
+	}
+	b.registriesPath = path.Clean(registriesPath)
+	return nil
+}
+
+// SetRegistriesMode sets the octal file mode of registries.conf, e.g. 0600
+// where it holds mirror credentials. An empty string selects the default,
+// 0644.
+func (b *ignitionBuilder) SetRegistriesMode(mode string) error {
+	if mode == "" {
+		b.registriesMode = defaultRegistriesMode
+		return nil
+	}
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0777 {
+		return fmt.Errorf("registries.conf file mode %q is not a valid octal permission", mode)
+	}
+	b.registriesMode = int(value)
+	return nil
+}
+
+// SetExtraFilesDir adds the files in dir to the ignition, at the same paths
+// relative to the root, e.g. dir/etc/motd is written to /etc/motd. The
+// directory is read each time the ignition is generated. An empty string adds
+// no files.
+func (b *ignitionBuilder) SetExtraFilesDir(dir string) error {
+	if dir != "" && !path.IsAbs(dir) {
+		return fmt.Errorf("extra files directory %q is not an absolute path", dir)
+	}
+	b.extraFilesDir = dir
+	return nil
+}
+
+// SetExtraFilesOwner sets the owner of the files added by SetExtraFilesDir, in
+// the form user[:group] with either given as a name or a numeric ID, e.g.
+// core:core for files the core user must be able to write. An empty string
+// leaves them owned by root.
+func (b *ignitionBuilder) SetExtraFilesOwner(owner string) error {
+	parsed, err := parseFileOwner(owner)
+	if err != nil {
+		return err
+	}
+	b.extraFilesOwner = parsed
+	return nil
+}
+
+// SetOverridesDir sets a directory of ignition fragments, named after the
+// host they apply to with an .ign suffix, that are merged into the ignition
+// of that host. This allows hosts to be customised in disconnected
+// environments. The directory is read each time the ignition is generated. An
+// empty string merges nothing.
+func (b *ignitionBuilder) SetOverridesDir(dir string) error {
+	if dir != "" && !path.IsAbs(dir) {
+		return fmt.Errorf("ignition overrides directory %q is not an absolute path", dir)
+	}
+	b.overridesDir = dir
+	return nil
+}
+
+// SetContext sets a context whose cancellation aborts building the ignition,
+// e.g. when the controller is shutting down.
+func (b *ignitionBuilder) SetContext(ctx context.Context) {
+	b.ctx = ctx
+}
+
+func (b *ignitionBuilder) context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+// SetPasswordLogin enables logging in to the agent host as the core user with
+// a password, including over SSH, for hosts that cannot be reached with a
+// key. Only a password hash in crypt(3) format is accepted, never the
+// password itself. If enabled is false, the hash is ignored.
+func (b *ignitionBuilder) SetPasswordLogin(enabled bool, hash string) error {
+	if !enabled {
+		b.ramDiskPasswordHash = ""
+		return nil
+	}
+	if hash == "" {
+		return errors.New("password login is enabled but no password hash is set")
+	}
+	if !cryptHashRegexp.MatchString(hash) {
+		return errors.New("the password hash is not in crypt(3) format; plain text passwords are not accepted")
+	}
+	b.ramDiskPasswordHash = hash
+	return nil
+}
+
+// SetLoginBanner sets a banner shown to anyone logging in to the agent host,
+// e.g. with ownership and contact details. It is written to both /etc/motd
+// and /etc/issue. An empty string leaves those files unchanged.
+func (b *ignitionBuilder) SetLoginBanner(banner string) {
+	if banner != "" && !strings.HasSuffix(banner, "\n") {
+		banner += "\n"
+	}
+	b.loginBanner = banner
+}
+
+// SetAgentImageTLSVerify configures whether the TLS certificate of the
+// registry is verified when pulling the agent image.
+func (b *ignitionBuilder) SetAgentImageTLSVerify(verify bool) {
+	b.agentImageTLSVerify = verify
+}
+
+// SetKeyFilesDir sets the directory the NetworkManager keyfiles generated
+// from the network state are written to. An empty string selects the default,
+// /etc/NetworkManager/system-connections.
+func (b *ignitionBuilder) SetKeyFilesDir(dir string) error {
+	if dir == "" {
+		dir = defaultKeyFilesDir
+	}
+	if !path.IsAbs(dir) {
+		return fmt.Errorf("keyfiles directory %q is not an absolute path", dir)
+	}
+	b.keyFilesDir = path.Clean(dir)
+	return nil
+}
+
+// SetNMStatectlTimeout limits how long nmstatectl may take to convert the
+// network data. A zero timeout selects the default of 15 seconds.
+func (b *ignitionBuilder) SetNMStatectlTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultNMStatectlTimeout
+	}
+	b.nmstatectlTimeout = timeout
+}
+
+// SetArchitecture sets the CPU architecture of the host the agent runs on.
+func (b *ignitionBuilder) SetArchitecture(arch string) {
+	b.architecture = arch
+}
+
+// SetStartTimeout limits how long the agent may take to start on hosts of
+// architectures without a timeout of their own, so that a stuck image pull
+// fails rather than hanging. A timeout of zero does not limit the start time.
+func (b *ignitionBuilder) SetStartTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("negative start timeout %s", timeout)
+	}
+	b.defaultStartTimeout = timeout
+	return nil
+}
+
+// SetReregister configures a systemd timer that restarts the agent every
+// interval while it is running, so that it registers with Ironic again if its
+// registration is lost during long-lived inspection. It is disabled unless
+// enabled is true.
+func (b *ignitionBuilder) SetReregister(enabled bool, interval time.Duration) error {
+	if !enabled {
+		b.reregisterInterval = 0
+		return nil
+	}
+	if interval < time.Second {
+		return fmt.Errorf("re-registration interval %s is shorter than a second", interval)
+	}
+	b.reregisterInterval = interval
+	return nil
+}
+
+// SetStartTimeouts limits how long the agent may take to start on hosts of
+// particular architectures, given as a comma-separated list of arch=timeout
+// pairs. Timeouts are durations such as 10m or a number of seconds. Other
+// architectures use the timeout set with SetStartTimeout.
+func (b *ignitionBuilder) SetStartTimeouts(timeouts string) error {
+	b.startTimeouts = map[string]time.Duration{}
+	for _, entry := range strings.Split(timeouts, ",") {
+		if entry == "" {
+			continue
+		}
+		arch, value, found := strings.Cut(entry, "=")
+		if !found || arch == "" {
+			return fmt.Errorf("invalid start timeout %q, expected arch=timeout", entry)
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			seconds, atoiErr := strconv.Atoi(value)
+			if atoiErr != nil {
+				return fmt.Errorf("invalid start timeout %q for %s: %w", value, arch, err)
+			}
+			timeout = time.Duration(seconds) * time.Second
+		}
+		if timeout < 0 {
+			return fmt.Errorf("negative start timeout %q for %s", value, arch)
+		}
+		b.startTimeouts[arch] = timeout
+	}
+	return nil
+}
+
+// SetRestartPolicy sets the systemd restart policy of the agent service. An
+// empty string selects the default, on-failure.
+func (b *ignitionBuilder) SetRestartPolicy(policy string) error {
+	switch policy {
+	case "", "no", "always", "on-success", "on-failure", "on-abnormal", "on-abort", "on-watchdog":
+		b.restartPolicy = policy
+		return nil
+	default:
+		return fmt.Errorf("unknown restart policy %q", policy)
+	}
+}
+
+// containerNameRegexp matches the container names accepted by podman.
+var containerNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// SetContainerName sets the name of the agent container. An empty string
+// selects the default, ironic-agent.
+func (b *ignitionBuilder) SetContainerName(name string) error {
+	if name != "" && !containerNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid container name %q", name)
+	}
+	b.containerName = name
+	return nil
+}
+
+// SetExtraMounts bind mounts additional host paths into the agent container,
+// each given as a src:dst pair of absolute paths. They are mounted in addition
+// to the paths the agent always needs.
+func (b *ignitionBuilder) SetExtraMounts(mounts []string) error {
+	b.extraMounts = nil
+	for _, mount := range mounts {
+		if mount == "" {
+			continue
+		}
+		src, dst, found := strings.Cut(mount, ":")
+		if !found || !path.IsAbs(src) || !path.IsAbs(dst) {
+			return fmt.Errorf("invalid mount %q, expected src:dst absolute paths", mount)
+		}
+		if strings.ContainsAny(mount, ", \t\n\"'%") {
+			return fmt.Errorf("invalid mount %q, paths must not contain commas, whitespace, quotes or %%", mount)
+		}
+		b.extraMounts = append(b.extraMounts,
+			fmt.Sprintf("--mount type=bind,src=%s,dst=%s", path.Clean(src), path.Clean(dst)))
+	}
+	return nil
+}
+
+// domainRegexp matches DNS domain names, e.g. example.com.
+var domainRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// SetHostnameDomain sets a domain appended to the hostname of the agent host,
+// so that it gets a fully qualified name. A hostname that already contains a
+// dot is used as it is. An empty string leaves the hostname unqualified.
+func (b *ignitionBuilder) SetHostnameDomain(domain string) error {
+	domain = strings.TrimPrefix(domain, ".")
+	if domain != "" && (len(domain) > 253 || !domainRegexp.MatchString(domain)) {
+		return fmt.Errorf("invalid hostname domain %q", domain)
+	}
+	b.hostnameDomain = domain
+	return nil
+}
+
+// fqdn returns the hostname of the agent host, qualified with the hostname
+// domain if one is set and the hostname is not already qualified.
+func (b *ignitionBuilder) fqdn() string {
+	if b.hostnameDomain == "" || strings.Contains(b.hostname, ".") {
+		return b.hostname
+	}
+	return b.hostname + "." + b.hostnameDomain
+}
+
+// envNameRegexp matches valid environment variable names.
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envAssignments returns the quoted NAME=value assignments of the given
+// environment variables, in the order of their names so that the generated
+// config is stable. The values must not need escaping in systemd units.
+func envAssignments(env map[string]string) ([]string, error) {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	assignments := make([]string, 0, len(names))
+	for _, name := range names {
+		if !envNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid environment variable name %q", name)
+		}
+		value := env[name]
+		if strings.ContainsAny(value, "\"\\%$\n\r") {
+			return nil, fmt.Errorf("invalid value of environment variable %s, it must not contain quotes, backslashes, %% or $", name)
+		}
+		assignments = append(assignments, fmt.Sprintf("\"%s=%s\"", name, value))
+	}
+	return assignments, nil
+}
+
+// SetExtraAgentEnv passes additional environment variables to the agent
+// container, e.g. IPA_ENABLE_PROFILER=true for debugging.
+func (b *ignitionBuilder) SetExtraAgentEnv(agentEnv map[string]string) error {
+	b.extraAgentEnv = nil
+	assignments, err := envAssignments(agentEnv)
+	if err != nil {
+		return fmt.Errorf("invalid agent environment: %w", err)
+	}
+	for _, assignment := range assignments {
+		b.extraAgentEnv = append(b.extraAgentEnv, "--env "+assignment)
+	}
+	return nil
+}
+
+// SetDefaultEnv sets environment variables, e.g. SSL_CERT_FILE, for every
+// service on the agent host through the systemd DefaultEnvironment. The proxy
+// settings are still set on the agent service itself.
+func (b *ignitionBuilder) SetDefaultEnv(defaultEnv map[string]string) error {
+	b.defaultEnv = nil
+	assignments, err := envAssignments(defaultEnv)
+	if err != nil {
+		return fmt.Errorf("invalid default environment: %w", err)
+	}
+	b.defaultEnv = assignments
+	return nil
+}
+
+// journalSizeRegexp matches the sizes accepted by journald.conf.
+var journalSizeRegexp = regexp.MustCompile(`^[0-9]+[KMGT]?$`)
+
+// SetJournal configures where journald stores the logs of the agent host
+// (volatile, persistent, auto or none) and caps the space they may use, e.g.
+// 200M, so that logs survive for inspection without filling the RAM disk. Empty
+// strings leave the journald defaults in place.
+func (b *ignitionBuilder) SetJournal(storage, maxUse string) error {
+	switch storage {
+	case "", "volatile", "persistent", "auto", "none":
+	default:
+		return fmt.Errorf("unknown journal storage %q", storage)
+	}
+	if maxUse != "" && !journalSizeRegexp.MatchString(maxUse) {
+		return fmt.Errorf("invalid journal size %q", maxUse)
+	}
+	b.journalStorage = storage
+	b.journalMaxUse = maxUse
+	return nil
+}
+
+// journaldConf returns the journald configuration, if any is set.
+func (b *ignitionBuilder) journaldConf() string {
+	if b.journalStorage == "" && b.journalMaxUse == "" {
+		return ""
+	}
+	contents := "[Journal]\n"
+	if b.journalStorage != "" {
+		contents += fmt.Sprintf("Storage=%s\n", b.journalStorage)
+	}
+	if b.journalMaxUse != "" {
+		// Cap both persistent and volatile logs, as with auto storage
+		// either may be used.
+		contents += fmt.Sprintf("SystemMaxUse=%s\nRuntimeMaxUse=%s\n", b.journalMaxUse, b.journalMaxUse)
+	}
+	return contents
+}
+
+// SetDNSServers sets the DNS servers used by the agent host, as a
+// comma-separated list of IP addresses, for networks whose DHCP servers
+// provide none. They are configured globally in NetworkManager, so they take
+// precedence over any DNS servers from DHCP or the network data. An empty
+// string leaves DNS unchanged.
+func (b *ignitionBuilder) SetDNSServers(servers string) error {
+	b.dnsServers = nil
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("DNS server %q is not an IP address", server)
+		}
+		b.dnsServers = append(b.dnsServers, server)
+	}
+	return nil
+}
+
+// SetRemoteSyslog forwards the logs of the agent host to a remote syslog
+// server, given as [udp://|tcp://]host[:port]. Without a scheme, UDP is used.
+// An empty string disables forwarding.
+func (b *ignitionBuilder) SetRemoteSyslog(server string) error {
+	b.remoteSyslog = ""
+	if server == "" {
+		return nil
+	}
+
+	action := "@"
+	if scheme, address, found := strings.Cut(server, "://"); found {
+		switch scheme {
+		case "udp":
+		case "tcp":
+			action = "@@"
+		default:
+			return fmt.Errorf("unsupported remote syslog protocol %q", scheme)
+		}
+		server = address
+	}
+
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = strings.Trim(server, "[]"), defaultSyslogPort
+	}
+	if host == "" {
+		return fmt.Errorf("invalid remote syslog server %q", server)
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	b.remoteSyslog = fmt.Sprintf("%s%s:%s", action, host, port)
+	return nil
+}
+
+// ipStackOptions maps the IP stack presets to the IP options passed to the
+// agent.
+var ipStackOptions = map[string]string{
+	"v4":   "ip=dhcp",
+	"v6":   "ip=dhcp6",
+	"dual": "ip=dhcp,dhcp6",
+	"auto": "",
+}
+
+// SetIPStack sets the IP options for the agent from an IP stack preset: v4,
+// v6, dual or auto. The preset cannot be combined with raw IP options, and an
+// empty string leaves the IP options unchanged.
+func (b *ignitionBuilder) SetIPStack(stack string) error {
+	if stack == "" {
+		return nil
+	}
+	options, exists := ipStackOptions[stack]
+	if !exists {
+		return fmt.Errorf("unknown IP stack %q", stack)
+	}
+	if b.ipOptions != "" {
+		return fmt.Errorf("IP stack %q cannot be combined with IP options %q", stack, b.ipOptions)
+	}
+	b.ipOptions = options
+	b.ipStackSet = true
+	return nil
+}
+
+// SetDefaultIPOptions sets the IP options used when neither IP options nor
+// an IP stack preset are given. An empty string passes no IP options to the
+// agent in that case.
+func (b *ignitionBuilder) SetDefaultIPOptions(options string) {
+	b.defaultIPOptions = options
+}
+
+// agentIPOptions returns the IP options passed to the agent.
+func (b *ignitionBuilder) agentIPOptions() string {
+	if b.ipOptions == "" && !b.ipStackSet {
+		return b.defaultIPOptions
+	}
+	return b.ipOptions
+}
+
+// SetInspectionDHCPAllInterfaces sets whether the agent runs DHCP on all
+// interfaces during inspection, rather than only on the PXE interface. This
+// can be slow on hosts with many disconnected NICs. An empty string leaves the
+// agent default in place.
+func (b *ignitionBuilder) SetInspectionDHCPAllInterfaces(value string) error {
+	b.inspectionDHCPAll = nil
+	if value == "" {
+		return nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value %q for DHCP on all interfaces during inspection", value)
+	}
+	b.inspectionDHCPAll = &enabled
+	return nil
+}
+
+// SetCollectLLDP sets whether the agent collects LLDP packets during
+// inspection, which can be slow where switches flood them. An empty string
+// leaves the agent default in place.
+func (b *ignitionBuilder) SetCollectLLDP(value string) error {
+	b.collectLLDP = nil
+	if value == "" {
+		return nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value %q for collecting LLDP", value)
+	}
+	b.collectLLDP = &enabled
+	return nil
+}
+
+// SetInspectionBenchmarks limits the benchmarks run by the extra-hardware
+// collector during inspection to a comma-separated list of cpu, disk and mem.
+// The value "none" disables benchmarks entirely, while an empty string leaves
+// the agent default in place.
+func (b *ignitionBuilder) SetInspectionBenchmarks(benchmarks string) error {
+	b.inspectionBenchmarks = nil
+	if benchmarks == "" {
+		return nil
+	}
+
+	b.inspectionBenchmarks = []string{}
+	if benchmarks == "none" {
+		return nil
+	}
+	for _, benchmark := range strings.Split(benchmarks, ",") {
+		switch benchmark {
+		case "cpu", "disk", "mem":
+			b.inspectionBenchmarks = append(b.inspectionBenchmarks, benchmark)
+		default:
+			return fmt.Errorf("unknown inspection benchmark %q", benchmark)
+		}
+	}
+	return nil
+}
+
+// nmstatectlGC converts NMState network data to NetworkManager keyfiles. If
+// nmstatectl fails, its complete stderr output is returned. Successful results
+// are cached, as hosts are frequently reconciled with unchanged network data.
+// If nmstatectl does not finish within the timeout, or parent is canceled
+// first, it is killed along with any processes it started.
+func nmstatectlGC(parent context.Context, nmStateData []byte, timeout time.Duration) (out []byte, stderr string, err error) {
+	if out, ok := nmstateCache.get(nmStateData); ok {
+		return out, "", nil
+	}
+
+	if timeout <= 0 {
+		timeout = defaultNMStatectlTimeout
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	nmstatectl := exec.CommandContext(ctx, "nmstatectl", "gc", "/dev/stdin")
+	nmstatectl.Stdin = strings.NewReader(string(nmStateData))
+	nmstatectl.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	nmstatectl.Cancel = func() error {
+		return syscall.Kill(-nmstatectl.Process.Pid, syscall.SIGKILL)
+	}
+	nmstatectl.WaitDelay = time.Second
+	out, err = nmstatectl.Output()
+	if parent.Err() != nil {
+		return nil, "", fmt.Errorf("nmstatectl aborted: %w", parent.Err())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, "", fmt.Errorf("nmstatectl timed out after %s: %w", timeout, context.DeadlineExceeded)
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		stderr = string(ee.Stderr)
+	}
+	if err == nil {
+		nmstateCache.add(nmStateData, out)
+	}
+	return
+}
+
+// ProcessNetworkState validates the network data. If it is invalid, the
+// returned message explains why, including the diagnostics from nmstatectl
+// verbatim.
 func (b *ignitionBuilder) ProcessNetworkState() (error, string) {
 	if len(b.nmStateData) > 0 {
-		nmstatectl := exec.Command("nmstatectl", "gc", "/dev/stdin")
-		nmstatectl.Stdin = strings.NewReader(string(b.nmStateData))
-		out, err := nmstatectl.Output()
+		out, stderr, err := nmstatectlGC(b.context(), b.nmStateData, b.nmstatectlTimeout)
 		if err != nil {
-			if ee, ok := err.(*exec.ExitError); ok {
-				return err, string(ee.Stderr)
-			}
-			return err, ""
+			return err, stderr
 		}
 		if string(out) == "--- {}\n" {
 			return nil, "no network configuration"
 		}
 		b.networkKeyFiles = out
+		b.networkStateProcessed = true
 	}
 	return nil, ""
 }
 
 func (b *ignitionBuilder) GenerateConfig() (config ignition_config_types_32.Config, err error) {
+	if b.verifyIronicTLS && len(b.ironicCACert) == 0 {
+		return config, errors.New("a CA certificate is required to verify Ironic TLS")
+	}
+
 	netFiles := []ignition_config_types_32.File{}
 	if len(b.nmStateData) > 0 {
-		nmstatectl := exec.Command("nmstatectl", "gc", "/dev/stdin")
-		nmstatectl.Stdin = strings.NewReader(string(b.nmStateData))
-		out, err := nmstatectl.Output()
-		if err != nil {
-			return config, err
+		// Reuse the output of ProcessNetworkState() if it has been called,
+		// even if it was empty.
+		out := b.networkKeyFiles
+		if !b.networkStateProcessed {
+			var stderr string
+			out, stderr, err = nmstatectlGC(b.context(), b.nmStateData, b.nmstatectlTimeout)
+			if err != nil {
+				if stderr != "" {
+					err = fmt.Errorf("%w: %s", err, stderr)
+				}
+				return config, err
+			}
 		}
 
-		netFiles, err = nmstateOutputToFiles(out)
+		netFiles, err = nmstateOutputToFiles(out, b.keyFilesDir)
 		if err != nil {
 			return config, err
 		}
@@ -117,13 +800,46 @@ func (b *ignitionBuilder) GenerateConfig() (config ignition_config_types_32.Conf
 		config.Storage.Files = append(config.Storage.Files, b.authFile())
 	}
 
-	if b.ironicRAMDiskSSHKey != "" {
-		config.Passwd.Users = append(config.Passwd.Users, ignition_config_types_32.PasswdUser{
-			Name: "core",
-			SSHAuthorizedKeys: []ignition_config_types_32.SSHAuthorizedKey{
+	if b.verifyIronicTLS {
+		config.Storage.Files = append(config.Storage.Files, ignitionFileEmbed(
+			ironicCACertPath,
+			0644, false,
+			b.ironicCACert))
+	}
+
+	if len(b.ironicClientCert) > 0 {
+		config.Storage.Files = append(config.Storage.Files,
+			ignitionFileEmbed(ironicClientCertPath, 0644, true, b.ironicClientCert),
+			ignitionFileEmbed(ironicClientKeyPath, 0600, true, b.ironicClientKey))
+	}
+
+	if b.reregisterInterval > 0 {
+		config.Systemd.Units = append(config.Systemd.Units, b.ReregisterUnits()...)
+	}
+
+	if len(b.trustBundle) > 0 {
+		config.Storage.Files = append(config.Storage.Files, ignitionFileEmbed(
+			trustBundlePath,
+			0644, true,
+			b.trustBundle))
+		config.Systemd.Units = append(config.Systemd.Units, b.UpdateCATrustService())
+	}
+
+	if b.ironicRAMDiskSSHKey != "" || b.ramDiskPasswordHash != "" {
+		user := ignition_config_types_32.PasswdUser{Name: "core"}
+		if b.ironicRAMDiskSSHKey != "" {
+			user.SSHAuthorizedKeys = []ignition_config_types_32.SSHAuthorizedKey{
 				ignition_config_types_32.SSHAuthorizedKey(strings.TrimSpace(b.ironicRAMDiskSSHKey)),
-			},
-		})
+			}
+		}
+		if b.ramDiskPasswordHash != "" {
+			user.PasswordHash = &b.ramDiskPasswordHash
+			config.Storage.Files = append(config.Storage.Files, ignitionFileEmbed(
+				sshdPasswordAuthPath,
+				0644, true,
+				[]byte("PasswordAuthentication yes\n")))
+		}
+		config.Passwd.Users = append(config.Passwd.Users, user)
 	}
 
 	config.Storage.Files = append(config.Storage.Files, ignitionFileEmbed(
@@ -131,6 +847,20 @@ func (b *ignitionBuilder) GenerateConfig() (config ignition_config_types_32.Conf
 		0644, false,
 		[]byte("[connection]\nipv6.dhcp-duid=ll\nipv6.dhcp-iaid=mac")))
 
+	if len(b.dnsServers) > 0 {
+		config.Storage.Files = append(config.Storage.Files, ignitionFileEmbed(
+			dnsServersPath,
+			0644, true,
+			[]byte(fmt.Sprintf("[global-dns-domain-*]\nservers=%s\n", strings.Join(b.dnsServers, ",")))))
+	}
+
+	if len(b.defaultEnv) > 0 {
+		config.Storage.Files = append(config.Storage.Files, ignitionFileEmbed(
+			defaultEnvPath,
+			0644, true,
+			[]byte(fmt.Sprintf("[Manager]\nDefaultEnvironment=%s\n", strings.Join(b.defaultEnv, " ")))))
+	}
+
 	if len(b.additionalNTPServers) > 0 {
 		additionalChronyConfig := strings.Builder{}
 		for _, server := range b.additionalNTPServers {
@@ -146,7 +876,7 @@ func (b *ignitionBuilder) GenerateConfig() (config ignition_config_types_32.Conf
 	if b.hostname != "" {
 		update_hostname := fmt.Sprintf(`
 	    [[ "$DHCP6_FQDN_FQDN" =~ "." ]] && hostnamectl set-hostname --static --transient $DHCP6_FQDN_FQDN 
-	    [[ "$(< /proc/sys/kernel/hostname)" =~ (localhost|localhost.localdomain) ]] && hostnamectl set-hostname --transient %s`, b.hostname)
+	    [[ "$(< /proc/sys/kernel/hostname)" =~ (localhost|localhost.localdomain) ]] && hostnamectl set-hostname --transient %s`, b.fqdn())
 
 		config.Storage.Files = append(config.Storage.Files, ignitionFileEmbed(
 			"/etc/NetworkManager/dispatcher.d/01-hostname",
@@ -154,17 +884,79 @@ func (b *ignitionBuilder) GenerateConfig() (config ignition_config_types_32.Conf
 			[]byte(update_hostname)))
 	}
 
-	if len(b.registriesConf) > 0 {
-		registriesFile := ignitionFileEmbed("/etc/containers/registries.conf",
+	if b.remoteSyslog != "" {
+		config.Storage.Files = append(config.Storage.Files, ignitionFileEmbed(
+			remoteSyslogPath,
 			0644, true,
-			b.registriesConf)
+			[]byte(fmt.Sprintf("*.* %s\n", b.remoteSyslog))))
+	}
+
+	if journaldConf := b.journaldConf(); journaldConf != "" {
+		config.Storage.Files = append(config.Storage.Files, ignitionFileEmbed(
+			journaldConfPath,
+			0644, true,
+			[]byte(journaldConf)))
+	}
+
+	if b.loginBanner != "" {
+		for _, bannerPath := range []string{"/etc/motd", "/etc/issue"} {
+			config.Storage.Files = append(config.Storage.Files, ignitionFileEmbed(
+				bannerPath,
+				0644, true,
+				[]byte(b.loginBanner)))
+		}
+	}
+
+	if len(b.registriesConf) > 0 {
+		registriesPath := b.registriesPath
+		if registriesPath == "" {
+			registriesPath = defaultRegistriesPath
+		}
+		// Only the main file replaces the one in the base image; a drop-in
+		// must not clobber an existing file of the same name.
+		overwrite := registriesPath == defaultRegistriesPath
+		registriesMode := b.registriesMode
+		if registriesMode == 0 {
+			registriesMode = defaultRegistriesMode
+		}
+
+		var registriesFile ignition_config_types_32.File
+		if b.compressRegistriesConf {
+			registriesFile, err = ignitionFileEmbedCompressed(registriesPath,
+				registriesMode, overwrite,
+				b.registriesConf)
+			if err != nil {
+				return config, err
+			}
+		} else {
+			registriesFile = ignitionFileEmbed(registriesPath,
+				registriesMode, overwrite,
+				b.registriesConf)
+		}
 
 		config.Storage.Files = append(config.Storage.Files, registriesFile)
 	}
 
-	report := config.Storage.Validate(vpath.ContextPath{})
-	if report.IsFatal() {
-		return config, errors.New(report.String())
+	if b.extraFilesDir != "" {
+		files, err := extraFiles(b.extraFilesDir, config.Storage.Files, b.extraFilesOwner)
+		if err != nil {
+			return config, fmt.Errorf("failed to read extra files: %w", err)
+		}
+		config.Storage.Files = append(config.Storage.Files, files...)
+	}
+
+	if b.overridesDir != "" {
+		override, err := ignitionOverride(b.overridesDir, b.hostname)
+		if err != nil {
+			return config, fmt.Errorf("failed to read ignition override: %w", err)
+		}
+		if override != nil {
+			config.Ignition.Config.Merge = append(config.Ignition.Config.Merge, *override)
+		}
+	}
+
+	if err := validateConfig(config); err != nil {
+		return config, err
 	}
 
 	return config, nil
@@ -1,10 +1,17 @@
 package ignition
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
 	"strings"
 	"testing"
+	"time"
 
+	ignition_config_types_32 "github.com/coreos/ignition/v2/config/v3_2/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/vincent-petithory/dataurl"
 )
 
 func TestGenerateStructure(t *testing.T) {
@@ -33,7 +40,7 @@ func TestGenerateWithMoreFields(t *testing.T) {
 	builder, err := New(nil, []byte("I am registry"),
 		"http://ironic.example.com", "http://inspector.example.com",
 		"quay.io/openshift-release-dev/ironic-ipa-image",
-		"pull secret", "SSH key", "ip=dhcp42",
+		"eyJhdXRocyI6e319", "SSH key", "ip=dhcp42",
 		"proxy me", "", "don't proxy me", "my-host", "", []string{})
 	assert.NoError(t, err)
 
@@ -57,6 +64,49 @@ func TestGenerateWithMoreFields(t *testing.T) {
 	assert.Len(t, ignition.Passwd.Users[0].SSHAuthorizedKeys, 1)
 }
 
+func TestGenerateHostnameDomain(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		domain   string
+		want     string
+		wantErr  bool
+	}{
+		{name: "no domain", hostname: "my-host", want: "--transient my-host"},
+		{name: "bare name", hostname: "my-host", domain: "example.com", want: "--transient my-host.example.com"},
+		{name: "leading dot", hostname: "my-host", domain: ".example.com", want: "--transient my-host.example.com"},
+		{name: "fqdn", hostname: "my-host.lab.example.com", domain: "example.com", want: "--transient my-host.lab.example.com"},
+		{name: "invalid", hostname: "my-host", domain: "example..com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := New(nil, nil,
+				"http://ironic.example.com", "",
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", "", "", "", "", tt.hostname, "", []string{})
+			assert.NoError(t, err)
+			err = builder.SetHostnameDomain(tt.domain)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			config, err := builder.GenerateConfig()
+			assert.NoError(t, err)
+
+			files := map[string]string{}
+			for _, f := range config.Storage.Files {
+				source, err := dataurl.DecodeString(*f.Contents.Source)
+				assert.NoError(t, err)
+				files[f.Path] = string(source.Data)
+			}
+			script := files["/etc/NetworkManager/dispatcher.d/01-hostname"]
+			assert.True(t, strings.HasSuffix(script, tt.want), script)
+		})
+	}
+}
+
 func TestGenerateRegistries(t *testing.T) {
 	registries := `
 [[registry]]
@@ -85,3 +135,722 @@ func TestGenerateRegistries(t *testing.T) {
 		t.Fatalf("Registries data not found in ignition:\n%s", string(ignition))
 	}
 }
+
+func TestGenerateRegistriesCompressed(t *testing.T) {
+	registries := strings.Repeat(`
+[[registry]]
+  prefix = ""
+  location = "quay.io/openshift-release-dev/ocp-v4.0-art-dev"
+  mirror-by-digest-only = true
+
+  [[registry.mirror]]
+    location = "virthost.ostest.test.metalkube.org:5000/localimages/local-release-image"
+`, 20)
+	builder, err := New([]byte{}, []byte(registries),
+		"http://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "", "", "", "virthost", "", []string{})
+	assert.NoError(t, err)
+	builder.SetCompressRegistriesConf(true)
+
+	config, err := builder.GenerateConfig()
+	assert.NoError(t, err)
+
+	var registriesFile *ignition_config_types_32.File
+	for i, f := range config.Storage.Files {
+		if f.Path == "/etc/containers/registries.conf" {
+			registriesFile = &config.Storage.Files[i]
+		}
+	}
+	if registriesFile == nil {
+		t.Fatal("registries.conf not found in ignition")
+	}
+	assert.Equal(t, "gzip", *registriesFile.Contents.Compression)
+
+	source, err := dataurl.DecodeString(*registriesFile.Contents.Source)
+	assert.NoError(t, err)
+	assert.Less(t, len(source.Data), len(registries))
+	zr, err := gzip.NewReader(bytes.NewReader(source.Data))
+	assert.NoError(t, err)
+	decoded, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, registries, string(decoded))
+}
+
+func TestGenerateRegistriesPath(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		wantPath      string
+		wantOverwrite bool
+		wantErr       bool
+	}{
+		{name: "default", wantPath: "/etc/containers/registries.conf", wantOverwrite: true},
+		{name: "drop-in", path: "/etc/containers/registries.conf.d/99-icc.conf", wantPath: "/etc/containers/registries.conf.d/99-icc.conf"},
+		{name: "relative", path: "registries.conf", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := New([]byte{}, []byte("[[registry]]\n"),
+				"http://ironic.example.com", "",
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", "", "", "", "", "virthost", "", []string{})
+			assert.NoError(t, err)
+			err = builder.SetRegistriesPath(tt.path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			config, err := builder.GenerateConfig()
+			assert.NoError(t, err)
+			found := false
+			for _, f := range config.Storage.Files {
+				if strings.HasPrefix(f.Path, "/etc/containers/") {
+					found = true
+					assert.Equal(t, tt.wantPath, f.Path)
+					assert.Equal(t, tt.wantOverwrite, *f.Overwrite)
+				}
+			}
+			assert.True(t, found, "registries.conf not found in ignition")
+		})
+	}
+}
+
+func TestGenerateRegistriesMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		compress bool
+		wantMode int
+		wantErr  bool
+	}{
+		{name: "default", wantMode: 0644},
+		{name: "restricted", mode: "0600", wantMode: 0600},
+		{name: "restricted compressed", mode: "600", compress: true, wantMode: 0600},
+		{name: "not octal", mode: "0689", wantErr: true},
+		{name: "too large", mode: "1777", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := New([]byte{}, []byte("[[registry]]\n"),
+				"http://ironic.example.com", "",
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", "", "", "", "", "virthost", "", []string{})
+			assert.NoError(t, err)
+			builder.SetCompressRegistriesConf(tt.compress)
+			err = builder.SetRegistriesMode(tt.mode)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			config, err := builder.GenerateConfig()
+			assert.NoError(t, err)
+			found := false
+			for _, f := range config.Storage.Files {
+				if f.Path == "/etc/containers/registries.conf" {
+					found = true
+					assert.Equal(t, tt.wantMode, *f.Mode)
+				}
+			}
+			assert.True(t, found, "registries.conf not found in ignition")
+		})
+	}
+}
+
+func TestGenerateReregister(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		interval time.Duration
+		wantErr  bool
+	}{
+		{name: "disabled", interval: time.Hour},
+		{name: "disabled without interval"},
+		{name: "enabled", enabled: true, interval: 30 * time.Minute},
+		{name: "interval too short", enabled: true, interval: time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := New([]byte{}, []byte{},
+				"http://ironic.example.com", "",
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", "", "", "", "", "virthost", "", []string{})
+			assert.NoError(t, err)
+			err = builder.SetReregister(tt.enabled, tt.interval)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			config, err := builder.GenerateConfig()
+			assert.NoError(t, err)
+			units := map[string]ignition_config_types_32.Unit{}
+			for _, unit := range config.Systemd.Units {
+				units[unit.Name] = unit
+			}
+			assert.Contains(t, units, "ironic-agent.service")
+			service, hasService := units["ironic-agent-reregister.service"]
+			timer, hasTimer := units["ironic-agent-reregister.timer"]
+			if !tt.enabled {
+				assert.False(t, hasService, "unexpected re-registration service")
+				assert.False(t, hasTimer, "unexpected re-registration timer")
+				return
+			}
+			assert.True(t, hasService, "re-registration service not found")
+			assert.True(t, hasTimer, "re-registration timer not found")
+			assert.Contains(t, *service.Contents, "ExecStart=/usr/bin/systemctl try-restart ironic-agent.service\n")
+			assert.Contains(t, *timer.Contents, "\nOnUnitActiveSec=1800\n")
+			assert.True(t, *timer.Enabled)
+		})
+	}
+}
+
+func TestGenerateLoginBanner(t *testing.T) {
+	tests := []struct {
+		name   string
+		banner string
+		want   string
+	}{
+		{name: "unset"},
+		{name: "set", banner: "Owned by the lab team, contact lab@example.com", want: "Owned by the lab team, contact lab@example.com\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := New(nil, nil,
+				"http://ironic.example.com", "",
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", "", "", "", "", "", "", []string{})
+			assert.NoError(t, err)
+			builder.SetLoginBanner(tt.banner)
+
+			config, err := builder.GenerateConfig()
+			assert.NoError(t, err)
+
+			files := map[string]string{}
+			for _, f := range config.Storage.Files {
+				source, err := dataurl.DecodeString(*f.Contents.Source)
+				assert.NoError(t, err)
+				files[f.Path] = string(source.Data)
+			}
+			for _, bannerPath := range []string{"/etc/motd", "/etc/issue"} {
+				if tt.want == "" {
+					assert.NotContains(t, files, bannerPath)
+				} else {
+					assert.Equal(t, tt.want, files[bannerPath])
+				}
+			}
+		})
+	}
+}
+
+func TestGeneratePasswordLogin(t *testing.T) {
+	hash := "$6$rounds=4096$saltsalt$c2FtcGxlaGFzaA"
+	tests := []struct {
+		name    string
+		enabled bool
+		hash    string
+		want    string
+		wantErr bool
+	}{
+		{name: "disabled"},
+		{name: "disabled with hash", hash: hash},
+		{name: "enabled", enabled: true, hash: hash, want: hash},
+		{name: "enabled without hash", enabled: true, wantErr: true},
+		{name: "plain text", enabled: true, hash: "hunter2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := New(nil, nil,
+				"http://ironic.example.com", "",
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", "", "", "", "", "", "", []string{})
+			assert.NoError(t, err)
+			err = builder.SetPasswordLogin(tt.enabled, tt.hash)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			config, err := builder.GenerateConfig()
+			assert.NoError(t, err)
+
+			paths := []string{}
+			for _, f := range config.Storage.Files {
+				paths = append(paths, f.Path)
+			}
+			if tt.want == "" {
+				assert.Empty(t, config.Passwd.Users)
+				assert.NotContains(t, paths, sshdPasswordAuthPath)
+				return
+			}
+			assert.Len(t, config.Passwd.Users, 1)
+			assert.Equal(t, "core", config.Passwd.Users[0].Name)
+			assert.Equal(t, tt.want, *config.Passwd.Users[0].PasswordHash)
+			assert.Contains(t, paths, sshdPasswordAuthPath)
+		})
+	}
+}
+
+func TestGenerateDefaultEnv(t *testing.T) {
+	builder, err := New(nil, nil,
+		"http://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "http://proxy.example.com:3128", "", "192.0.2.0/24", "", "", []string{})
+	assert.NoError(t, err)
+
+	config, err := builder.GenerateConfig()
+	assert.NoError(t, err)
+	for _, f := range config.Storage.Files {
+		assert.NotEqual(t, defaultEnvPath, f.Path)
+	}
+
+	assert.Error(t, builder.SetDefaultEnv(map[string]string{"SSL-CERT-FILE": "/etc/ssl.pem"}))
+	assert.Error(t, builder.SetDefaultEnv(map[string]string{"SSL_CERT_FILE": `/etc/ssl.pem" FOO="bar`}))
+
+	assert.NoError(t, builder.SetDefaultEnv(map[string]string{
+		"SSL_CERT_FILE": "/etc/pki/tls/certs/custom.pem",
+		"LANG":          "C.UTF-8",
+	}))
+	config, err = builder.GenerateConfig()
+	assert.NoError(t, err)
+
+	files := map[string]string{}
+	for _, f := range config.Storage.Files {
+		source, err := dataurl.DecodeString(*f.Contents.Source)
+		assert.NoError(t, err)
+		files[f.Path] = string(source.Data)
+	}
+	assert.Equal(t, "[Manager]\nDefaultEnvironment=\"LANG=C.UTF-8\" \"SSL_CERT_FILE=/etc/pki/tls/certs/custom.pem\"\n",
+		files[defaultEnvPath])
+	assert.Contains(t, *config.Systemd.Units[0].Contents, "Environment=\"HTTP_PROXY=http://proxy.example.com:3128\"\n")
+	assert.Contains(t, *config.Systemd.Units[0].Contents, "Environment=\"NO_PROXY=192.0.2.0/24\"\n")
+}
+
+func TestGenerateDNSServers(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers string
+		want    string
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "single", servers: "192.0.2.53", want: "[global-dns-domain-*]\nservers=192.0.2.53\n"},
+		{name: "dual-stack", servers: "192.0.2.53, 2001:db8::53", want: "[global-dns-domain-*]\nservers=192.0.2.53,2001:db8::53\n"},
+		{name: "hostname", servers: "dns.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := New(nil, nil,
+				"http://ironic.example.com", "",
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", "", "", "", "", "", "", []string{})
+			assert.NoError(t, err)
+			err = builder.SetDNSServers(tt.servers)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			config, err := builder.GenerateConfig()
+			assert.NoError(t, err)
+
+			files := map[string]string{}
+			for _, f := range config.Storage.Files {
+				source, err := dataurl.DecodeString(*f.Contents.Source)
+				assert.NoError(t, err)
+				files[f.Path] = string(source.Data)
+			}
+			if tt.want == "" {
+				assert.NotContains(t, files, dnsServersPath)
+			} else {
+				assert.Equal(t, tt.want, files[dnsServersPath])
+			}
+		})
+	}
+}
+
+func TestGenerateJournal(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage string
+		maxUse  string
+		want    string
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "persistent", storage: "persistent", want: "[Journal]\nStorage=persistent\n"},
+		{name: "capped", storage: "persistent", maxUse: "200M", want: "[Journal]\nStorage=persistent\nSystemMaxUse=200M\nRuntimeMaxUse=200M\n"},
+		{name: "cap only", maxUse: "1G", want: "[Journal]\nSystemMaxUse=1G\nRuntimeMaxUse=1G\n"},
+		{name: "bad storage", storage: "disk", wantErr: true},
+		{name: "bad size", maxUse: "lots", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := New(nil, nil,
+				"http://ironic.example.com", "",
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", "", "", "", "", "", "", []string{})
+			assert.NoError(t, err)
+			err = builder.SetJournal(tt.storage, tt.maxUse)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			config, err := builder.GenerateConfig()
+			assert.NoError(t, err)
+
+			files := map[string]string{}
+			for _, f := range config.Storage.Files {
+				source, err := dataurl.DecodeString(*f.Contents.Source)
+				assert.NoError(t, err)
+				files[f.Path] = string(source.Data)
+			}
+			if tt.want == "" {
+				assert.NotContains(t, files, journaldConfPath)
+			} else {
+				assert.Equal(t, tt.want, files[journaldConfPath])
+			}
+		})
+	}
+}
+
+func TestGenerateIronicTLS(t *testing.T) {
+	builder, err := New(nil, nil,
+		"https://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "", "", "", "", "", []string{})
+	assert.NoError(t, err)
+
+	builder.SetIronicTLS(false, nil)
+	_, err = builder.GenerateConfig()
+	assert.Error(t, err)
+
+	builder.SetIronicTLS(false, []byte("my CA"))
+	ignition, err := builder.GenerateConfig()
+	assert.NoError(t, err)
+
+	assert.Len(t, ignition.Storage.Files, 3)
+	assert.Contains(t, *ignition.Storage.Files[0].Contents.Source, "insecure%20%3D%20False")
+	assert.Contains(t, *ignition.Storage.Files[0].Contents.Source, "cafile%20%3D%20%2Fetc%2Fironic-python-agent%2Fironic-ca.crt")
+	assert.Equal(t, "/etc/ironic-ca.crt", ignition.Storage.Files[1].Path)
+	assert.Equal(t, "data:text/plain,my%20CA", *ignition.Storage.Files[1].Contents.Source)
+	assert.Contains(t, *ignition.Systemd.Units[0].Contents,
+		"--mount type=bind,src=/etc/ironic-ca.crt,dst=/etc/ironic-python-agent/ironic-ca.crt")
+}
+
+func TestGenerateIronicClientCert(t *testing.T) {
+	builder, err := New(nil, nil,
+		"https://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "", "", "", "", "", []string{})
+	assert.NoError(t, err)
+
+	assert.Error(t, builder.SetIronicClientCert([]byte("my cert"), nil))
+	assert.Error(t, builder.SetIronicClientCert(nil, []byte("my key")))
+
+	ignition, err := builder.GenerateConfig()
+	assert.NoError(t, err)
+	assert.NotContains(t, *ignition.Storage.Files[0].Contents.Source, "certfile")
+	assert.NotContains(t, *ignition.Systemd.Units[0].Contents, "ironic-client")
+
+	assert.NoError(t, builder.SetIronicClientCert([]byte("my cert"), []byte("my key")))
+	ignition, err = builder.GenerateConfig()
+	assert.NoError(t, err)
+
+	conf, err := dataurl.DecodeString(*ignition.Storage.Files[0].Contents.Source)
+	assert.NoError(t, err)
+	assert.Contains(t, string(conf.Data), "certfile = /etc/ironic-python-agent/ironic-client.crt\n")
+	assert.Contains(t, string(conf.Data), "keyfile = /etc/ironic-python-agent/ironic-client.key\n")
+
+	files := map[string]ignition_config_types_32.File{}
+	for _, f := range ignition.Storage.Files {
+		files[f.Path] = f
+	}
+	if assert.Contains(t, files, "/etc/ironic-client.crt") {
+		assert.Equal(t, 0644, *files["/etc/ironic-client.crt"].Mode)
+	}
+	if assert.Contains(t, files, "/etc/ironic-client.key") {
+		assert.Equal(t, 0600, *files["/etc/ironic-client.key"].Mode)
+	}
+	assert.Contains(t, *ignition.Systemd.Units[0].Contents,
+		"--mount type=bind,src=/etc/ironic-client.crt,dst=/etc/ironic-python-agent/ironic-client.crt")
+	assert.Contains(t, *ignition.Systemd.Units[0].Contents,
+		"--mount type=bind,src=/etc/ironic-client.key,dst=/etc/ironic-python-agent/ironic-client.key")
+}
+
+func TestGenerateTrustBundle(t *testing.T) {
+	builder, err := New(nil, nil,
+		"http://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "", "", "", "", "", []string{})
+	assert.NoError(t, err)
+
+	ignition, err := builder.GenerateConfig()
+	assert.NoError(t, err)
+	assert.Len(t, ignition.Systemd.Units, 1)
+	for _, f := range ignition.Storage.Files {
+		assert.NotEqual(t, "/etc/pki/ca-trust/source/anchors/icc-ca.pem", f.Path)
+	}
+
+	builder.SetTrustBundle([]byte("my CA"))
+	ignition, err = builder.GenerateConfig()
+	assert.NoError(t, err)
+	assert.Len(t, ignition.Systemd.Units, 2)
+	assert.Equal(t, "icc-update-ca-trust.service", ignition.Systemd.Units[1].Name)
+	assert.Contains(t, *ignition.Systemd.Units[1].Contents, "ExecStart=/usr/bin/update-ca-trust extract")
+	assert.Equal(t, "/etc/pki/ca-trust/source/anchors/icc-ca.pem", ignition.Storage.Files[1].Path)
+	assert.Equal(t, "data:text/plain,my%20CA", *ignition.Storage.Files[1].Contents.Source)
+}
+
+func TestGenerateProxy(t *testing.T) {
+	builder, err := New(nil, nil,
+		"http://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "http://proxy.example.com:3128", "", "192.0.2.0/24", "", "", []string{})
+	assert.NoError(t, err)
+
+	ignition, err := builder.GenerateConfig()
+	assert.NoError(t, err)
+
+	contents := *ignition.Systemd.Units[0].Contents
+	assert.Contains(t, contents, "[Service]\nEnvironment=\"HTTP_PROXY=http://proxy.example.com:3128\"\nEnvironment=\"NO_PROXY=192.0.2.0/24\"\n")
+	assert.NotContains(t, contents, "HTTPS_PROXY")
+}
+
+func TestGenerateRemoteSyslog(t *testing.T) {
+	tests := []struct {
+		server  string
+		want    string
+		wantErr bool
+	}{
+		{server: "", want: ""},
+		{server: "syslog.example.com", want: "*.* @syslog.example.com:514\n"},
+		{server: "udp://192.0.2.1:1514", want: "*.* @192.0.2.1:1514\n"},
+		{server: "tcp://syslog.example.com", want: "*.* @@syslog.example.com:514\n"},
+		{server: "2001:db8::1", want: "*.* @[2001:db8::1]:514\n"},
+		{server: "tcp://[2001:db8::1]:6514", want: "*.* @@[2001:db8::1]:6514\n"},
+		{server: "http://syslog.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			builder, err := New(nil, nil,
+				"http://ironic.example.com", "",
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", "", "", "", "", "", "", []string{})
+			assert.NoError(t, err)
+
+			err = builder.SetRemoteSyslog(tt.server)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			ignition, err := builder.GenerateConfig()
+			assert.NoError(t, err)
+
+			var found *string
+			for _, f := range ignition.Storage.Files {
+				if f.Path == "/etc/rsyslog.d/90-icc-remote.conf" {
+					found = f.Contents.Source
+				}
+			}
+			if tt.want == "" {
+				assert.Nil(t, found)
+			} else if assert.NotNil(t, found) {
+				assert.Equal(t, toDataUrl([]byte(tt.want)), *found)
+			}
+		})
+	}
+}
+
+func TestSetKeyFilesDir(t *testing.T) {
+	builder, err := New(nil, nil,
+		"http://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "", "", "", "", "", []string{})
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/NetworkManager/system-connections", builder.keyFilesDir)
+
+	assert.NoError(t, builder.SetKeyFilesDir("/etc/icc/connections/"))
+	assert.Equal(t, "/etc/icc/connections", builder.keyFilesDir)
+
+	assert.NoError(t, builder.SetKeyFilesDir(""))
+	assert.Equal(t, "/etc/NetworkManager/system-connections", builder.keyFilesDir)
+
+	assert.Error(t, builder.SetKeyFilesDir("connections"))
+}
+
+// hangingNMStatectl is the body of a stand-in for nmstatectl that hangs, in a
+// child process that holds its output open.
+const hangingNMStatectl = "sleep 60 &\nwait\n"
+
+func TestNMStatectlGCTimeout(t *testing.T) {
+	fakeNMStatectl(t, hangingNMStatectl)
+	nmstateCache = newNMStateCache(nmstateCacheSize)
+
+	start := time.Now()
+	_, _, err := nmstatectlGC(context.Background(), []byte("hang"), 100*time.Millisecond)
+	assert.ErrorContains(t, err, "nmstatectl timed out after 100ms")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestNMStatectlGCCanceled(t *testing.T) {
+	fakeNMStatectl(t, hangingNMStatectl)
+	nmstateCache = newNMStateCache(nmstateCacheSize)
+
+	builder, err := New([]byte("hang"), nil,
+		"http://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "", "", "", "", "", []string{})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	builder.SetContext(ctx)
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err, _ = builder.ProcessNetworkState()
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestGenerateReusesNetworkState(t *testing.T) {
+	calls := fakeNMStatectl(t, echoNMStatectl)
+	// Disable the cache, so that every conversion runs nmstatectl.
+	nmstateCache = newNMStateCache(0)
+	t.Cleanup(func() { nmstateCache = newNMStateCache(nmstateCacheSize) })
+
+	nmstate := []byte("NetworkManager:\n- - eth0.nmconnection\n  - '[connection]'\n")
+	builder, err := New(nmstate, nil,
+		"http://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "", "", "", "", "", []string{})
+	assert.NoError(t, err)
+
+	err, message := builder.ProcessNetworkState()
+	assert.NoError(t, err)
+	assert.Empty(t, message)
+	ignition, err := builder.GenerateConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/NetworkManager/system-connections/eth0.nmconnection", ignition.Storage.Files[1].Path)
+	assert.Equal(t, 1, countCalls(t, calls))
+
+	// Generating without processing the network state first still works.
+	builder, err = New(nmstate, nil,
+		"http://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "", "", "", "", "", []string{})
+	assert.NoError(t, err)
+	ignition, err = builder.GenerateConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/NetworkManager/system-connections/eth0.nmconnection", ignition.Storage.Files[1].Path)
+	assert.Equal(t, 2, countCalls(t, calls))
+}
+
+func TestGenerateReusesEmptyNetworkState(t *testing.T) {
+	// Stand in for nmstatectl, converting the network state to no keyfiles.
+	calls := fakeNMStatectl(t, "cat >/dev/null\n")
+	nmstateCache = newNMStateCache(0)
+	t.Cleanup(func() { nmstateCache = newNMStateCache(nmstateCacheSize) })
+
+	builder, err := New([]byte("interfaces: []\n"), nil,
+		"http://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "", "", "", "", "", []string{})
+	assert.NoError(t, err)
+
+	err, message := builder.ProcessNetworkState()
+	assert.NoError(t, err)
+	assert.Empty(t, message)
+	_, err = builder.GenerateConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, countCalls(t, calls))
+}
+
+func TestNewBaseURLs(t *testing.T) {
+	tests := []struct {
+		name          string
+		ironicURL     string
+		inspectorURL  string
+		wantAPIURL    string
+		wantInspector string
+		wantErr       bool
+	}{
+		{
+			name:          "host",
+			ironicURL:     "http://ironic.example.com",
+			inspectorURL:  "http://inspector.example.com",
+			wantAPIURL:    "http://ironic.example.com:6385",
+			wantInspector: "http://inspector.example.com:5050/v1/continue",
+		},
+		{
+			name:          "port",
+			ironicURL:     "http://ironic.example.com:8080",
+			inspectorURL:  "http://inspector.example.com:8081",
+			wantAPIURL:    "http://ironic.example.com:8080",
+			wantInspector: "http://inspector.example.com:8081/v1/continue",
+		},
+		{
+			name:          "path",
+			ironicURL:     "http://ironic.example.com/baremetal",
+			inspectorURL:  "http://inspector.example.com/inspector",
+			wantAPIURL:    "http://ironic.example.com:6385/baremetal",
+			wantInspector: "http://inspector.example.com:5050/inspector/v1/continue",
+		},
+		{
+			name:          "multiple",
+			ironicURL:     "https://ironic-0.example.com, https://ironic-1.example.com:8443",
+			inspectorURL:  "https://ironic-0.example.com,https://ironic-1.example.com",
+			wantAPIURL:    "https://ironic-0.example.com:6385,https://ironic-1.example.com:8443",
+			wantInspector: "https://ironic-0.example.com:5050/v1/continue,https://ironic-1.example.com:5050/v1/continue",
+		},
+		{
+			name:      "no scheme",
+			ironicURL: "ironic.example.com:6385",
+			wantErr:   true,
+		},
+		{
+			name:      "no host",
+			ironicURL: "http:///baremetal",
+			wantErr:   true,
+		},
+		{
+			name:         "bad inspector",
+			ironicURL:    "http://ironic.example.com",
+			inspectorURL: "http://inspector.example.com,ftp://inspector.example.com",
+			wantErr:      true,
+		},
+		{
+			name:      "unparseable",
+			ironicURL: "http://ironic.example.com:port",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := New(nil, nil,
+				tt.ironicURL, tt.inspectorURL,
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", "", "", "", "", "", "", []string{})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			conf, err := dataurl.DecodeString(*builder.IronicAgentConf("").Contents.Source)
+			assert.NoError(t, err)
+			assert.Contains(t, string(conf.Data), "api_url = "+tt.wantAPIURL+"\n")
+			assert.Contains(t, string(conf.Data), "inspection_callback_url = "+tt.wantInspector+"\n")
+		})
+	}
+}
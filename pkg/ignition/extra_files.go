@@ -0,0 +1,90 @@
+package ignition
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	ignition_config_types_32 "github.com/coreos/ignition/v2/config/v3_2/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// maxExtraFilesDepth limits how deeply nested the extra files may be, which
+// also guards against symlink loops.
+const maxExtraFilesDepth = 16
+
+var extraFilesLog = log.Log.WithName("ignition").WithName("extra-files")
+
+// extraFiles returns the files in dir as ignition files, at the same paths
+// relative to the root and with the same permissions. Files that cannot be
+// read, have special mode bits set or would replace a file already in the
+// ignition are skipped with a warning. Symlinks are followed, but entries
+// whose names start with "..", as used by Kubernetes to update ConfigMap
+// volumes atomically, are ignored.
+func extraFiles(dir string, existing []ignition_config_types_32.File, owner fileOwner) ([]ignition_config_types_32.File, error) {
+	paths := map[string]bool{}
+	for _, f := range existing {
+		paths[f.Path] = true
+	}
+
+	files := []ignition_config_types_32.File{}
+	var walk func(dir, target string, depth int) error
+	walk = func(dir, target string, depth int) error {
+		if depth > maxExtraFilesDepth {
+			return fmt.Errorf("extra files nested too deeply at %s", dir)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "..") {
+				continue
+			}
+			filePath := filepath.Join(dir, entry.Name())
+			filePathTarget := path.Join(target, entry.Name())
+			log := extraFilesLog.WithValues("file", filePath)
+
+			info, err := os.Stat(filePath)
+			if err != nil {
+				log.Info("skipping unreadable extra ignition file", "error", err.Error())
+				continue
+			}
+			if info.IsDir() {
+				if err := walk(filePath, filePathTarget, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			if info.Mode()&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) != 0 {
+				log.Info("skipping extra ignition file with special mode bits", "mode", info.Mode().String())
+				continue
+			}
+			if paths[filePathTarget] {
+				log.Info("skipping extra ignition file that would replace a generated file", "path", filePathTarget)
+				continue
+			}
+
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				log.Info("skipping unreadable extra ignition file", "error", err.Error())
+				continue
+			}
+			files = append(files, ignitionFileEmbedOwned(filePathTarget, int(info.Mode().Perm()), true, data, owner))
+			paths[filePathTarget] = true
+		}
+		return nil
+	}
+
+	if err := walk(dir, "/", 0); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -0,0 +1,132 @@
+package ignition
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	ignition_config_types_32 "github.com/coreos/ignition/v2/config/v3_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/vincent-petithory/dataurl"
+	"k8s.io/utils/pointer"
+)
+
+func TestGenerateExtraFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []struct {
+		name string
+		mode os.FileMode
+		data string
+	}{
+		{name: "etc/motd", mode: 0644, data: "Welcome\n"},
+		{name: "etc/audit/rules.d/icc.rules", mode: 0600, data: "-w /etc/passwd -p wa\n"},
+		// Would replace a generated file
+		{name: "etc/ironic-python-agent.conf", mode: 0644, data: "[DEFAULT]\n"},
+		// Internal to ConfigMap volumes
+		{name: "..data/etc/motd", mode: 0644, data: "Hidden\n"},
+	} {
+		filePath := filepath.Join(dir, f.name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		assert.NoError(t, os.WriteFile(filePath, []byte(f.data), f.mode))
+		assert.NoError(t, os.Chmod(filePath, f.mode))
+	}
+	// Nested ConfigMap items are symlinks to directories
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "..data", "etc", "issue.d"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "..data", "etc", "issue.d", "icc.issue"), []byte("Managed\n"), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "etc"), 0755))
+	assert.NoError(t, os.Symlink(filepath.Join("..", "..data", "etc", "issue.d"), filepath.Join(dir, "etc", "issue.d")))
+
+	builder, err := New(nil, nil,
+		"http://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "", "", "", "", "", []string{})
+	assert.NoError(t, err)
+	assert.NoError(t, builder.SetExtraFilesDir(dir))
+
+	config, err := builder.GenerateConfig()
+	assert.NoError(t, err)
+
+	files := map[string]string{}
+	modes := map[string]int{}
+	for _, f := range config.Storage.Files {
+		source, err := dataurl.DecodeString(*f.Contents.Source)
+		assert.NoError(t, err)
+		files[f.Path] = string(source.Data)
+		modes[f.Path] = *f.Mode
+	}
+	assert.Equal(t, "Welcome\n", files["/etc/motd"])
+	assert.Equal(t, 0644, modes["/etc/motd"])
+	assert.Equal(t, "-w /etc/passwd -p wa\n", files["/etc/audit/rules.d/icc.rules"])
+	assert.Equal(t, 0600, modes["/etc/audit/rules.d/icc.rules"])
+	assert.NotEqual(t, "[DEFAULT]\n", files["/etc/ironic-python-agent.conf"])
+	assert.Equal(t, "Managed\n", files["/etc/issue.d/icc.issue"])
+	assert.NotContains(t, files, "/..data/etc/motd")
+}
+
+func TestSetExtraFilesDirRelative(t *testing.T) {
+	b := &ignitionBuilder{}
+	assert.Error(t, b.SetExtraFilesDir("extra"))
+	assert.NoError(t, b.SetExtraFilesDir(""))
+}
+
+func TestGenerateExtraFilesOwner(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "var", "home", "core"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "var", "home", "core", "notes"), []byte("notes\n"), 0644))
+
+	tests := []struct {
+		name      string
+		owner     string
+		wantUser  ignition_config_types_32.NodeUser
+		wantGroup ignition_config_types_32.NodeGroup
+	}{
+		{name: "default"},
+		{
+			name:      "names",
+			owner:     "core:wheel",
+			wantUser:  ignition_config_types_32.NodeUser{Name: pointer.String("core")},
+			wantGroup: ignition_config_types_32.NodeGroup{Name: pointer.String("wheel")},
+		},
+		{
+			name:     "user ID",
+			owner:    "1000",
+			wantUser: ignition_config_types_32.NodeUser{ID: pointer.Int(1000)},
+		},
+		{
+			name:      "IDs",
+			owner:     "1000:1000",
+			wantUser:  ignition_config_types_32.NodeUser{ID: pointer.Int(1000)},
+			wantGroup: ignition_config_types_32.NodeGroup{ID: pointer.Int(1000)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := New(nil, nil,
+				"http://ironic.example.com", "",
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", "", "", "", "", "", "", []string{})
+			assert.NoError(t, err)
+			assert.NoError(t, builder.SetExtraFilesDir(dir))
+			assert.NoError(t, builder.SetExtraFilesOwner(tt.owner))
+
+			config, err := builder.GenerateConfig()
+			assert.NoError(t, err)
+
+			for _, f := range config.Storage.Files {
+				if f.Path == "/var/home/core/notes" {
+					assert.Equal(t, tt.wantUser, f.User)
+					assert.Equal(t, tt.wantGroup, f.Group)
+					return
+				}
+			}
+			t.Error("extra file not added")
+		})
+	}
+}
+
+func TestSetExtraFilesOwnerInvalid(t *testing.T) {
+	b := &ignitionBuilder{}
+	for _, owner := range []string{":core", "core:", "core :core"} {
+		assert.Error(t, b.SetExtraFilesOwner(owner), owner)
+	}
+}
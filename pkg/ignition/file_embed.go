@@ -1,6 +1,12 @@
 package ignition
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strconv"
+	"strings"
+
 	ignition_types "github.com/coreos/ignition/v2/config/v3_2/types"
 	"github.com/vincent-petithory/dataurl"
 )
@@ -28,6 +34,49 @@ func ignitionFileEmbed(path string, mode int, overwrite bool, data []byte) ignit
 	}
 }
 
+// fileOwner is the user and group owning a file, each given as a name or a
+// numeric ID. Empty values leave the default ownership, root.
+type fileOwner struct {
+	user  string
+	group string
+}
+
+// parseFileOwner parses an owner in the form user[:group].
+func parseFileOwner(owner string) (fileOwner, error) {
+	if owner == "" {
+		return fileOwner{}, nil
+	}
+	user, group, hasGroup := strings.Cut(owner, ":")
+	if user == "" || (hasGroup && group == "") || strings.ContainsAny(owner, " \t\n") {
+		return fileOwner{}, fmt.Errorf("invalid file owner %q, expected user[:group]", owner)
+	}
+	return fileOwner{user: user, group: group}, nil
+}
+
+// apply sets the ownership of f.
+func (o fileOwner) apply(f ignition_types.File) ignition_types.File {
+	if o.user != "" {
+		if id, err := strconv.Atoi(o.user); err == nil {
+			f.User = ignition_types.NodeUser{ID: &id}
+		} else {
+			f.User = ignition_types.NodeUser{Name: &o.user}
+		}
+	}
+	if o.group != "" {
+		if id, err := strconv.Atoi(o.group); err == nil {
+			f.Group = ignition_types.NodeGroup{ID: &id}
+		} else {
+			f.Group = ignition_types.NodeGroup{Name: &o.group}
+		}
+	}
+	return f
+}
+
+// ignitionFileEmbedOwned embeds the data in a file owned by owner.
+func ignitionFileEmbedOwned(path string, mode int, overwrite bool, data []byte, owner fileOwner) ignition_types.File {
+	return owner.apply(ignitionFileEmbed(path, mode, overwrite, data))
+}
+
 func ignitionFileEmbedAppend(path string, mode int, data []byte) ignition_types.File {
 	source := toDataUrl(data)
 	return ignition_types.File{
@@ -38,3 +87,26 @@ func ignitionFileEmbedAppend(path string, mode int, data []byte) ignition_types.
 		},
 	}
 }
+
+// ignitionFileEmbedCompressed embeds the data gzip-compressed, for files large
+// enough that the size of the ignition matters.
+func ignitionFileEmbedCompressed(path string, mode int, overwrite bool, data []byte) (ignition_types.File, error) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(data); err != nil {
+		return ignition_types.File{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return ignition_types.File{}, err
+	}
+
+	source := dataurl.New(compressed.Bytes(), "application/gzip").String()
+	compression := "gzip"
+	return ignition_types.File{
+		Node: ignition_types.Node{Path: path, Overwrite: &overwrite},
+		FileEmbedded1: ignition_types.FileEmbedded1{
+			Contents: ignition_types.Resource{Source: &source, Compression: &compression},
+			Mode:     &mode,
+		},
+	}, nil
+}
@@ -1,15 +1,23 @@
 package ignition
 
 import (
+	"path"
+
 	ignition_config_types_32 "github.com/coreos/ignition/v2/config/v3_2/types"
 	"sigs.k8s.io/yaml"
 )
 
+// defaultKeyFilesDir is where NetworkManager looks for connection profiles.
+const defaultKeyFilesDir = "/etc/NetworkManager/system-connections"
+
 type nmstateOutput struct {
 	NetworkManager [][]string `yaml:"NetworkManager"`
 }
 
-func nmstateOutputToFiles(generatedConfig []byte) ([]ignition_config_types_32.File, error) {
+// nmstateOutputToFiles returns the NetworkManager keyfiles generated by
+// nmstatectl as files in dir. They are only readable by root, as
+// NetworkManager ignores keyfiles that are not.
+func nmstateOutputToFiles(generatedConfig []byte, dir string) ([]ignition_config_types_32.File, error) {
 	files := []ignition_config_types_32.File{}
 
 	networkManagerConfig := &nmstateOutput{}
@@ -22,7 +30,7 @@ func nmstateOutputToFiles(generatedConfig []byte) ([]ignition_config_types_32.Fi
 	}
 	for _, v := range networkManagerConfig.NetworkManager {
 		files = append(files,
-			ignitionFileEmbed("/etc/NetworkManager/system-connections/"+v[0],
+			ignitionFileEmbed(path.Join(dir, v[0]),
 				0600, true,
 				[]byte(v[1])))
 	}
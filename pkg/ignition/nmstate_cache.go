@@ -0,0 +1,70 @@
+package ignition
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+)
+
+// nmstateCacheSize is the number of network data conversions that are kept.
+const nmstateCacheSize = 256
+
+var nmstateCache = newNMStateCache(nmstateCacheSize)
+
+// nmstateCacheEntry is the output of nmstatectl for the network data with the
+// given hash.
+type nmstateCacheEntry struct {
+	key [sha256.Size]byte
+	out []byte
+}
+
+// nmStateCache is a least-recently-used cache of nmstatectl output, keyed by
+// the SHA256 hash of the network data.
+type nmStateCache struct {
+	size    int
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List
+	mu      sync.Mutex
+}
+
+func newNMStateCache(size int) *nmStateCache {
+	return &nmStateCache{
+		size:    size,
+		entries: map[[sha256.Size]byte]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+func (c *nmStateCache) get(nmStateData []byte) ([]byte, bool) {
+	key := sha256.Sum256(nmStateData)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*nmstateCacheEntry).out, true
+}
+
+func (c *nmStateCache) add(nmStateData, out []byte) {
+	key := sha256.Sum256(nmStateData)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, exists := c.entries[key]; exists {
+		elem.Value.(*nmstateCacheEntry).out = out
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&nmstateCacheEntry{key: key, out: out})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*nmstateCacheEntry).key)
+	}
+}
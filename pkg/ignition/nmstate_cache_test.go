@@ -0,0 +1,104 @@
+package ignition
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoNMStatectl is the body of a stand-in for nmstatectl that echoes its
+// input.
+const echoNMStatectl = "cat\n"
+
+// fakeNMStatectl installs a stand-in for nmstatectl that runs the given shell
+// script body and records each invocation in the returned file.
+func fakeNMStatectl(t testing.TB, body string) string {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := fmt.Sprintf("#!/bin/sh\necho call >>%s\n%s", calls, body)
+	if err := os.WriteFile(filepath.Join(dir, "nmstatectl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return calls
+}
+
+func countCalls(t testing.TB, calls string) int {
+	data, err := os.ReadFile(calls)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "call\n")
+}
+
+func TestNMStateCache(t *testing.T) {
+	c := newNMStateCache(2)
+
+	c.add([]byte("a"), []byte("A"))
+	c.add([]byte("b"), []byte("B"))
+	out, ok := c.get([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, "A", string(out))
+
+	// b is now the least recently used entry
+	c.add([]byte("c"), []byte("C"))
+	_, ok = c.get([]byte("b"))
+	assert.False(t, ok)
+	out, ok = c.get([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, "A", string(out))
+	out, ok = c.get([]byte("c"))
+	assert.True(t, ok)
+	assert.Equal(t, "C", string(out))
+}
+
+func TestNMStatectlGCCached(t *testing.T) {
+	calls := fakeNMStatectl(t, echoNMStatectl)
+	nmstateCache = newNMStateCache(nmstateCacheSize)
+
+	for i := 0; i < 3; i++ {
+		out, _, err := nmstatectlGC(context.Background(), []byte("first"), defaultNMStatectlTimeout)
+		assert.NoError(t, err)
+		assert.Equal(t, "first", string(out))
+	}
+	assert.Equal(t, 1, countCalls(t, calls))
+
+	out, _, err := nmstatectlGC(context.Background(), []byte("second"), defaultNMStatectlTimeout)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(out))
+	assert.Equal(t, 2, countCalls(t, calls))
+}
+
+func BenchmarkNMStatectlGC(b *testing.B) {
+	calls := fakeNMStatectl(b, echoNMStatectl)
+
+	b.Run("uncached", func(b *testing.B) {
+		nmstateCache = newNMStateCache(nmstateCacheSize)
+		before := countCalls(b, calls)
+		for i := 0; i < b.N; i++ {
+			if _, _, err := nmstatectlGC(context.Background(), []byte(fmt.Sprintf("host-%d", i)), defaultNMStatectlTimeout); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(countCalls(b, calls)-before), "execs")
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		nmstateCache = newNMStateCache(nmstateCacheSize)
+		before := countCalls(b, calls)
+		for i := 0; i < b.N; i++ {
+			if _, _, err := nmstatectlGC(context.Background(), []byte("host"), defaultNMStatectlTimeout); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(countCalls(b, calls)-before), "execs")
+	})
+}
@@ -15,6 +15,7 @@ func TestNMStateOutputToFiles(t *testing.T) {
 	tests := []struct {
 		name            string
 		generatedConfig []byte
+		dir             string
 		want            []ignition_config_types_32.File
 		wantErr         bool
 	}{
@@ -135,10 +136,36 @@ NetworkManager:
 				},
 			},
 		},
+		{
+			name: "custom dir",
+			generatedConfig: []byte(`---
+NetworkManager:
+- - eth1.nmconnection
+  - '[connection]
+
+	id=eth1
+	'
+`),
+			dir: "/etc/icc/connections",
+			want: []ignition_config_types_32.File{
+				{
+					Node: ignition_config_types_32.Node{Path: "/etc/icc/connections/eth1.nmconnection", Overwrite: &expectedOverwrite},
+					FileEmbedded1: ignition_config_types_32.FileEmbedded1{
+						Contents: ignition_config_types_32.Resource{
+							Source: pointer.String("data:text/plain,%5Bconnection%5D%0Aid%3Deth1%20")},
+						Mode: &expectedMode,
+					},
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := nmstateOutputToFiles(tt.generatedConfig)
+			dir := tt.dir
+			if dir == "" {
+				dir = defaultKeyFilesDir
+			}
+			got, err := nmstateOutputToFiles(tt.generatedConfig, dir)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ignitionBuilder.nmstateOutputToFiles() error = %v, wantErr %v", err, tt.wantErr)
 				return
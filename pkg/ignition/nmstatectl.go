@@ -0,0 +1,39 @@
+package ignition
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// nmstatectlCheckTimeout limits how long checking for nmstatectl may take.
+const nmstatectlCheckTimeout = 10 * time.Second
+
+var nmstatectlAvailable = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "icc_nmstatectl_available",
+	Help: "Whether nmstatectl, needed to convert host network data, can be run.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(nmstatectlAvailable)
+}
+
+// CheckNMStatectl verifies that nmstatectl can be run, returning its version.
+// Without it, building the image for any host with network data fails.
+func CheckNMStatectl() (version string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), nmstatectlCheckTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "nmstatectl", "--version").Output()
+	if err != nil {
+		nmstatectlAvailable.Set(0)
+		return "", fmt.Errorf("nmstatectl cannot be run: %w", err)
+	}
+	nmstatectlAvailable.Set(1)
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,36 @@
+package ignition
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func nmstatectlAvailableValue(t *testing.T) float64 {
+	m := &dto.Metric{}
+	if err := nmstatectlAvailable.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestCheckNMStatectl(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PATH", dir)
+
+	_, err := CheckNMStatectl()
+	assert.Error(t, err)
+	assert.Equal(t, 0.0, nmstatectlAvailableValue(t))
+
+	script := "#!/bin/sh\necho nmstatectl 2.2.15\n"
+	if err := os.WriteFile(filepath.Join(dir, "nmstatectl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	version, err := CheckNMStatectl()
+	assert.NoError(t, err)
+	assert.Equal(t, "nmstatectl 2.2.15", version)
+	assert.Equal(t, 1.0, nmstatectlAvailableValue(t))
+}
@@ -0,0 +1,64 @@
+package ignition
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	ignition_config_types_32 "github.com/coreos/ignition/v2/config/v3_2/types"
+	"github.com/coreos/vcontext/validate"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// InvalidConfigError is returned when the generated ignition, or an override
+// merged into it, fails validation. Retrying will not help until the inputs
+// are fixed.
+type InvalidConfigError struct {
+	message string
+}
+
+func (e InvalidConfigError) Error() string {
+	return e.message
+}
+
+// validateConfig runs the validation of the ignition library on the whole of
+// config, so that an ignition that would be rejected at boot is caught while
+// building the image.
+func validateConfig(config ignition_config_types_32.Config) error {
+	report := validate.Validate(config, "json")
+	if report.IsFatal() {
+		return InvalidConfigError{message: "invalid ignition config: " + report.String()}
+	}
+	return nil
+}
+
+// ignitionOverride returns the override fragment for hostname in dir, named
+// <hostname>.ign, as a resource to merge into the ignition. The fragment is
+// embedded, so that the host does not need to fetch anything to apply it.
+// If there is no fragment for the host, nil is returned.
+func ignitionOverride(dir, hostname string) (*ignition_config_types_32.Resource, error) {
+	if hostname == "" || filepath.Base(hostname) != hostname {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, hostname+".ign"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	override := ignition_config_types_32.Config{}
+	if err := json.Unmarshal(data, &override); err != nil {
+		return nil, InvalidConfigError{message: fmt.Sprintf("ignition override for %s is not valid JSON: %v", hostname, err)}
+	}
+	if err := validateConfig(override); err != nil {
+		return nil, fmt.Errorf("ignition override for %s is invalid: %w", hostname, err)
+	}
+
+	source := dataurl.New(data, "application/json").String()
+	return &ignition_config_types_32.Resource{Source: &source}, nil
+}
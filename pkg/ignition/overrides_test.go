@@ -0,0 +1,69 @@
+package ignition
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vincent-petithory/dataurl"
+)
+
+func TestGenerateIgnitionOverride(t *testing.T) {
+	dir := t.TempDir()
+	override := `{"ignition":{"version":"3.2.0"},"passwd":{"users":[{"name":"core"}]}}`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "worker-0.ign"), []byte(override), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "worker-1.ign"), []byte("{"), 0644))
+
+	generate := func(hostname string) ([]string, error) {
+		builder, err := New(nil, nil,
+			"http://ironic.example.com", "",
+			"quay.io/openshift-release-dev/ironic-ipa-image",
+			"", "", "", "", "", "", hostname, "", []string{})
+		assert.NoError(t, err)
+		assert.NoError(t, builder.SetOverridesDir(dir))
+
+		config, err := builder.GenerateConfig()
+		merged := []string{}
+		for _, r := range config.Ignition.Config.Merge {
+			source, err := dataurl.DecodeString(*r.Source)
+			assert.NoError(t, err)
+			merged = append(merged, string(source.Data))
+		}
+		return merged, err
+	}
+
+	merged, err := generate("worker-0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{override}, merged)
+
+	merged, err = generate("worker-2")
+	assert.NoError(t, err)
+	assert.Empty(t, merged)
+
+	_, err = generate("worker-1")
+	assert.Error(t, err)
+}
+
+func TestGenerateIgnitionOverrideInvalidMode(t *testing.T) {
+	dir := t.TempDir()
+	override := `{"ignition":{"version":"3.2.0"},"storage":{"files":[{"path":"/etc/motd","mode":65535}]}}`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "worker-0.ign"), []byte(override), 0644))
+
+	builder, err := New(nil, nil,
+		"http://ironic.example.com", "",
+		"quay.io/openshift-release-dev/ironic-ipa-image",
+		"", "", "", "", "", "", "worker-0", "", []string{})
+	assert.NoError(t, err)
+	assert.NoError(t, builder.SetOverridesDir(dir))
+
+	_, err = builder.GenerateConfig()
+	assert.ErrorAs(t, err, &InvalidConfigError{})
+	assert.ErrorContains(t, err, "$.storage.files.0.mode")
+}
+
+func TestSetOverridesDirRelative(t *testing.T) {
+	b := &ignitionBuilder{}
+	assert.Error(t, b.SetOverridesDir("overrides"))
+	assert.NoError(t, b.SetOverridesDir(""))
+}
@@ -1,6 +1,8 @@
 package ignition
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
@@ -13,19 +15,61 @@ import (
 const (
 	defaultIronicPort    = "6385"
 	defaultInspectorPort = "5050"
+
+	defaultRestartPolicy = "on-failure"
+	defaultContainerName = "ironic-agent"
+
+	// ironicAgentCACertPath is where the Ironic CA certificate is mounted in
+	// the agent container.
+	ironicAgentCACertPath = "/etc/ironic-python-agent/ironic-ca.crt"
+
+	// ironicAgentClientCertPath and ironicAgentClientKeyPath are where the
+	// Ironic client certificate and key are mounted in the agent container.
+	ironicAgentClientCertPath = "/etc/ironic-python-agent/ironic-client.crt"
+	ironicAgentClientKeyPath  = "/etc/ironic-python-agent/ironic-client.key"
 )
 
+// validateURLs checks that a comma-separated list of base URLs contains only
+// absolute HTTP(S) URLs.
+func validateURLs(baseURLs string) error {
+	for _, urlString := range strings.Split(baseURLs, ",") {
+		urlString = strings.TrimSpace(urlString)
+		if urlString == "" {
+			continue
+		}
+
+		parsed, err := url.Parse(urlString)
+		if err != nil {
+			return err
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("URL %q must use http or https", urlString)
+		}
+		if parsed.Hostname() == "" {
+			return fmt.Errorf("URL %q has no host", urlString)
+		}
+		if parsed.RawQuery != "" || parsed.Fragment != "" {
+			return fmt.Errorf("URL %q must not have a query or fragment", urlString)
+		}
+	}
+	return nil
+}
+
+// processURLs adds the default port and path to each of a comma-separated list
+// of base URLs. The agent tries each URL in the list in turn, e.g. the
+// addresses of several Ironic instances or both IPv4 and IPv6 addresses.
 func processURLs(baseURL, defaultPath, defaultPort string) string {
 	urls := strings.Split(baseURL, ",")
 	var result []string
 	for _, urlString := range urls {
+		urlString = strings.TrimSpace(urlString)
 		if urlString == "" {
 			continue // tolerate empty strings or trailing commas
 		}
 
 		parsed, err := url.Parse(urlString)
 		if err != nil {
-			continue // I wish we had a logger here...
+			continue // rejected by validateURLs()
 		}
 
 		if defaultPort != "" && parsed.Port() == "" {
@@ -42,47 +86,129 @@ func processURLs(baseURL, defaultPath, defaultPort string) string {
 	return strings.Join(result, ",")
 }
 
+// confBool formats a boolean option of ironic-python-agent.conf.
+func confBool(value bool) string {
+	if value {
+		return "True"
+	}
+	return "False"
+}
+
 func (b *ignitionBuilder) IronicAgentConf(ironicInspectorVlanInterfaces string) ignition_config_types_32.File {
 	template := `
 [DEFAULT]
 api_url = %s
 inspection_callback_url = %s
-insecure = True
+insecure = %s
 enable_vlan_interfaces = %s
 `
 	ironicURLs := processURLs(b.ironicBaseURL, "", defaultIronicPort)
 	inspectorURLs := processURLs(b.ironicInspectorBaseURL, "/v1/continue", defaultInspectorPort)
-	contents := fmt.Sprintf(template, ironicURLs, inspectorURLs, ironicInspectorVlanInterfaces)
+	insecure := "True"
+	if b.verifyIronicTLS {
+		insecure = "False"
+	}
+	contents := fmt.Sprintf(template, ironicURLs, inspectorURLs, insecure, ironicInspectorVlanInterfaces)
+	if b.verifyIronicTLS {
+		contents += fmt.Sprintf("cafile = %s\n", ironicAgentCACertPath)
+	}
+	if len(b.ironicClientCert) > 0 {
+		contents += fmt.Sprintf("certfile = %s\nkeyfile = %s\n", ironicAgentClientCertPath, ironicAgentClientKeyPath)
+	}
+	if b.inspectionDHCPAll != nil {
+		contents += fmt.Sprintf("inspection_dhcp_all_interfaces = %s\n", confBool(*b.inspectionDHCPAll))
+	}
+	if b.collectLLDP != nil {
+		contents += fmt.Sprintf("collect_lldp = %s\n", confBool(*b.collectLLDP))
+	}
+	if b.inspectionBenchmarks != nil {
+		contents += fmt.Sprintf("inspection_benchmarks = %s\n", strings.Join(b.inspectionBenchmarks, ","))
+	}
 	return ignitionFileEmbed("/etc/ironic-python-agent.conf", 0644, false, []byte(contents))
 }
 
+// agentArchFlags are the additional podman flags used to run the agent on
+// hosts of each architecture.
+var agentArchFlags = map[string]string{
+	// Select the arm64 variant of multi-arch agent images explicitly, rather
+	// than relying on the platform podman detects.
+	"aarch64": "--arch=arm64",
+}
+
 func (b *ignitionBuilder) IronicAgentService(copyNetwork bool) ignition_config_types_32.Unit {
-	flags := ironicAgentPodmanFlags
+	// https://github.com/openshift/ironic-image/blob/master/scripts/configure-coreos-ipa#L14
+	flags := fmt.Sprintf("--tls-verify=%t", b.agentImageTLSVerify)
+	if archFlags, exists := agentArchFlags[b.architecture]; exists {
+		flags += " " + archFlags
+	}
 	if b.ironicAgentPullSecret != "" {
 		flags += " --authfile=/etc/authfile.json"
 	}
 
+	mounts := ""
+	if b.verifyIronicTLS {
+		mounts += fmt.Sprintf(" --mount type=bind,src=%s,dst=%s", ironicCACertPath, ironicAgentCACertPath)
+	}
+	if len(b.ironicClientCert) > 0 {
+		mounts += fmt.Sprintf(" --mount type=bind,src=%s,dst=%s", ironicClientCertPath, ironicAgentClientCertPath)
+		mounts += fmt.Sprintf(" --mount type=bind,src=%s,dst=%s", ironicClientKeyPath, ironicAgentClientKeyPath)
+	}
+	for _, mount := range b.extraMounts {
+		mounts += " " + mount
+	}
+
+	agentEnv := ""
+	for _, env := range b.extraAgentEnv {
+		agentEnv += " " + env
+	}
+
+	// Set the proxy on the unit itself, so that podman uses it to pull the
+	// agent image as well as passing it on to the agent.
+	environment := ""
+	for _, proxy := range []struct{ name, value string }{
+		{"HTTP_PROXY", b.httpProxy},
+		{"HTTPS_PROXY", b.httpsProxy},
+		{"NO_PROXY", b.noProxy},
+	} {
+		if proxy.value != "" {
+			environment += fmt.Sprintf("Environment=\"%s=%s\"\n", proxy.name, proxy.value)
+		}
+	}
+
+	// A timeout of zero disables it.
+	startTimeout, exists := b.startTimeouts[b.architecture]
+	if !exists {
+		startTimeout = b.defaultStartTimeout
+	}
+
+	restartPolicy := b.restartPolicy
+	if restartPolicy == "" {
+		restartPolicy = defaultRestartPolicy
+	}
+
+	containerName := b.containerName
+	if containerName == "" {
+		containerName = defaultContainerName
+	}
+
 	unitTemplate := `[Unit]
 Description=Ironic Agent
 After=network-online.target
 Wants=network-online.target
 [Service]
-Environment="HTTP_PROXY=%s"
-Environment="HTTPS_PROXY=%s"
-Environment="NO_PROXY=%s"
-TimeoutStartSec=0
-Restart=on-failure
+%sTimeoutStartSec=%d
+Restart=%s
 RestartSec=5
 StartLimitIntervalSec=0
 Type=notify
 ExecStartPre=/bin/rm -f %%t/%%n.ctr-id
-ExecStart=/bin/podman run --detach --cgroups=no-conmon --sdnotify=conmon --rm --cidfile=%%t/%%n.ctr-id --privileged --network host --mount type=bind,src=/etc/ironic-python-agent.conf,dst=/etc/ironic-python-agent/ignition.conf --mount type=bind,src=/dev,dst=/dev --mount type=bind,src=/sys,dst=/sys --mount type=bind,src=/run/dbus/system_bus_socket,dst=/run/dbus/system_bus_socket --mount type=bind,src=/,dst=/mnt/coreos --mount type=bind,src=/run/udev,dst=/run/udev --ipc=host --uts=host --env "IPA_COREOS_IP_OPTIONS=%s" --env IPA_COREOS_COPY_NETWORK=%v --env "IPA_DEFAULT_HOSTNAME=%s" %s --name ironic-agent %s
+ExecStart=/bin/podman run --detach --cgroups=no-conmon --sdnotify=conmon --rm --cidfile=%%t/%%n.ctr-id --privileged --network host --mount type=bind,src=/etc/ironic-python-agent.conf,dst=/etc/ironic-python-agent/ignition.conf --mount type=bind,src=/dev,dst=/dev --mount type=bind,src=/sys,dst=/sys --mount type=bind,src=/run/dbus/system_bus_socket,dst=/run/dbus/system_bus_socket --mount type=bind,src=/,dst=/mnt/coreos --mount type=bind,src=/run/udev,dst=/run/udev%s --ipc=host --uts=host --env "IPA_COREOS_IP_OPTIONS=%s" --env IPA_COREOS_COPY_NETWORK=%v --env "IPA_DEFAULT_HOSTNAME=%s"%s %s --name %s %s
 ExecStop=/usr/bin/podman stop --ignore --cidfile=%%t/%%n.ctr-id
 ExecStopPost=/usr/bin/podman rm -f --ignore --cidfile=%%t/%%n.ctr-id
 [Install]
 WantedBy=multi-user.target
 `
-	contents := fmt.Sprintf(unitTemplate, b.httpProxy, b.httpsProxy, b.noProxy, b.ipOptions, copyNetwork, b.hostname, flags, b.ironicAgentImage)
+	contents := fmt.Sprintf(unitTemplate, environment, int(startTimeout.Seconds()), restartPolicy, mounts, b.agentIPOptions(), copyNetwork, b.hostname, agentEnv, flags, containerName, b.ironicAgentImage)
 
 	return ignition_config_types_32.Unit{
 		Name:     "ironic-agent.service",
@@ -91,6 +217,80 @@ WantedBy=multi-user.target
 	}
 }
 
+func (b *ignitionBuilder) UpdateCATrustService() ignition_config_types_32.Unit {
+	contents := `[Unit]
+Description=Update CA trust
+DefaultDependencies=no
+Before=ironic-agent.service
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/update-ca-trust extract
+RemainAfterExit=yes
+[Install]
+WantedBy=multi-user.target
+`
+	return ignition_config_types_32.Unit{
+		Name:     "icc-update-ca-trust.service",
+		Enabled:  pointer.Bool(true),
+		Contents: &contents,
+	}
+}
+
+// ReregisterUnits returns a timer, and the service it activates, that restart
+// the agent periodically so that it looks itself up in Ironic again. The
+// restart only happens if the agent is running.
+func (b *ignitionBuilder) ReregisterUnits() []ignition_config_types_32.Unit {
+	serviceContents := `[Unit]
+Description=Re-register the Ironic Agent
+After=ironic-agent.service
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/systemctl try-restart ironic-agent.service
+`
+	timerContents := fmt.Sprintf(`[Unit]
+Description=Periodically re-register the Ironic Agent
+[Timer]
+OnActiveSec=%d
+OnUnitActiveSec=%d
+[Install]
+WantedBy=timers.target
+`, int(b.reregisterInterval.Seconds()), int(b.reregisterInterval.Seconds()))
+
+	return []ignition_config_types_32.Unit{
+		{
+			Name:     "ironic-agent-reregister.service",
+			Contents: &serviceContents,
+		},
+		{
+			Name:     "ironic-agent-reregister.timer",
+			Enabled:  pointer.Bool(true),
+			Contents: &timerContents,
+		},
+	}
+}
+
+// validatePullSecret checks that the base64-encoded pull secret decodes to a
+// docker config JSON document with an "auths" section, so that a malformed
+// secret is reported before it is embedded rather than failing image pulls
+// on the host.
+func validatePullSecret(secret string) error {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secret))
+	if err != nil {
+		return InvalidConfigError{message: fmt.Sprintf("pull secret is not valid base64: %v", err)}
+	}
+
+	var dockerConfig struct {
+		Auths map[string]json.RawMessage `json:"auths"`
+	}
+	if err := json.Unmarshal(decoded, &dockerConfig); err != nil {
+		return InvalidConfigError{message: fmt.Sprintf("pull secret is not valid docker config JSON: %v", err)}
+	}
+	if dockerConfig.Auths == nil {
+		return InvalidConfigError{message: "pull secret has no \"auths\" section"}
+	}
+	return nil
+}
+
 func (b *ignitionBuilder) authFile() ignition_config_types_32.File {
 	source := "data:;base64," + strings.TrimSpace(b.ironicAgentPullSecret)
 	return ignition_config_types_32.File{
@@ -2,7 +2,9 @@ package ignition
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	ignition_config_types_32 "github.com/coreos/ignition/v2/config/v3_2/types"
 	"github.com/google/go-cmp/cmp"
@@ -88,7 +90,7 @@ func TestIronicAgentService(t *testing.T) {
 			want: ignition_config_types_32.Unit{
 				Name:     "ironic-agent.service",
 				Enabled:  pointer.Bool(true),
-				Contents: pointer.String("[Unit]\nDescription=Ironic Agent\nAfter=network-online.target\nWants=network-online.target\n[Service]\nEnvironment=\"HTTP_PROXY=\"\nEnvironment=\"HTTPS_PROXY=\"\nEnvironment=\"NO_PROXY=\"\nTimeoutStartSec=0\nRestart=on-failure\nRestartSec=5\nStartLimitIntervalSec=0\nType=notify\nExecStartPre=/bin/rm -f %t/%n.ctr-id\nExecStart=/bin/podman run --detach --cgroups=no-conmon --sdnotify=conmon --rm --cidfile=%t/%n.ctr-id --privileged --network host --mount type=bind,src=/etc/ironic-python-agent.conf,dst=/etc/ironic-python-agent/ignition.conf --mount type=bind,src=/dev,dst=/dev --mount type=bind,src=/sys,dst=/sys --mount type=bind,src=/run/dbus/system_bus_socket,dst=/run/dbus/system_bus_socket --mount type=bind,src=/,dst=/mnt/coreos --mount type=bind,src=/run/udev,dst=/run/udev --ipc=host --uts=host --env \"IPA_COREOS_IP_OPTIONS=ip=dhcp6\" --env IPA_COREOS_COPY_NETWORK=false --env \"IPA_DEFAULT_HOSTNAME=my-host\" --tls-verify=false --authfile=/etc/authfile.json --name ironic-agent http://example.com/foo:latest\nExecStop=/usr/bin/podman stop --ignore --cidfile=%t/%n.ctr-id\nExecStopPost=/usr/bin/podman rm -f --ignore --cidfile=%t/%n.ctr-id\n[Install]\nWantedBy=multi-user.target\n"),
+				Contents: pointer.String("[Unit]\nDescription=Ironic Agent\nAfter=network-online.target\nWants=network-online.target\n[Service]\nTimeoutStartSec=0\nRestart=on-failure\nRestartSec=5\nStartLimitIntervalSec=0\nType=notify\nExecStartPre=/bin/rm -f %t/%n.ctr-id\nExecStart=/bin/podman run --detach --cgroups=no-conmon --sdnotify=conmon --rm --cidfile=%t/%n.ctr-id --privileged --network host --mount type=bind,src=/etc/ironic-python-agent.conf,dst=/etc/ironic-python-agent/ignition.conf --mount type=bind,src=/dev,dst=/dev --mount type=bind,src=/sys,dst=/sys --mount type=bind,src=/run/dbus/system_bus_socket,dst=/run/dbus/system_bus_socket --mount type=bind,src=/,dst=/mnt/coreos --mount type=bind,src=/run/udev,dst=/run/udev --ipc=host --uts=host --env \"IPA_COREOS_IP_OPTIONS=ip=dhcp6\" --env IPA_COREOS_COPY_NETWORK=false --env \"IPA_DEFAULT_HOSTNAME=my-host\" --tls-verify=false --authfile=/etc/authfile.json --name ironic-agent http://example.com/foo:latest\nExecStop=/usr/bin/podman stop --ignore --cidfile=%t/%n.ctr-id\nExecStopPost=/usr/bin/podman rm -f --ignore --cidfile=%t/%n.ctr-id\n[Install]\nWantedBy=multi-user.target\n"),
 			},
 		},
 		{
@@ -97,7 +99,7 @@ func TestIronicAgentService(t *testing.T) {
 			want: ignition_config_types_32.Unit{
 				Name:     "ironic-agent.service",
 				Enabled:  pointer.Bool(true),
-				Contents: pointer.String("[Unit]\nDescription=Ironic Agent\nAfter=network-online.target\nWants=network-online.target\n[Service]\nEnvironment=\"HTTP_PROXY=\"\nEnvironment=\"HTTPS_PROXY=\"\nEnvironment=\"NO_PROXY=\"\nTimeoutStartSec=0\nRestart=on-failure\nRestartSec=5\nStartLimitIntervalSec=0\nType=notify\nExecStartPre=/bin/rm -f %t/%n.ctr-id\nExecStart=/bin/podman run --detach --cgroups=no-conmon --sdnotify=conmon --rm --cidfile=%t/%n.ctr-id --privileged --network host --mount type=bind,src=/etc/ironic-python-agent.conf,dst=/etc/ironic-python-agent/ignition.conf --mount type=bind,src=/dev,dst=/dev --mount type=bind,src=/sys,dst=/sys --mount type=bind,src=/run/dbus/system_bus_socket,dst=/run/dbus/system_bus_socket --mount type=bind,src=/,dst=/mnt/coreos --mount type=bind,src=/run/udev,dst=/run/udev --ipc=host --uts=host --env \"IPA_COREOS_IP_OPTIONS=ip=dhcp6\" --env IPA_COREOS_COPY_NETWORK=false --env \"IPA_DEFAULT_HOSTNAME=my-host\" --tls-verify=false --name ironic-agent http://example.com/foo:latest\nExecStop=/usr/bin/podman stop --ignore --cidfile=%t/%n.ctr-id\nExecStopPost=/usr/bin/podman rm -f --ignore --cidfile=%t/%n.ctr-id\n[Install]\nWantedBy=multi-user.target\n"),
+				Contents: pointer.String("[Unit]\nDescription=Ironic Agent\nAfter=network-online.target\nWants=network-online.target\n[Service]\nTimeoutStartSec=0\nRestart=on-failure\nRestartSec=5\nStartLimitIntervalSec=0\nType=notify\nExecStartPre=/bin/rm -f %t/%n.ctr-id\nExecStart=/bin/podman run --detach --cgroups=no-conmon --sdnotify=conmon --rm --cidfile=%t/%n.ctr-id --privileged --network host --mount type=bind,src=/etc/ironic-python-agent.conf,dst=/etc/ironic-python-agent/ignition.conf --mount type=bind,src=/dev,dst=/dev --mount type=bind,src=/sys,dst=/sys --mount type=bind,src=/run/dbus/system_bus_socket,dst=/run/dbus/system_bus_socket --mount type=bind,src=/,dst=/mnt/coreos --mount type=bind,src=/run/udev,dst=/run/udev --ipc=host --uts=host --env \"IPA_COREOS_IP_OPTIONS=ip=dhcp6\" --env IPA_COREOS_COPY_NETWORK=false --env \"IPA_DEFAULT_HOSTNAME=my-host\" --tls-verify=false --name ironic-agent http://example.com/foo:latest\nExecStop=/usr/bin/podman stop --ignore --cidfile=%t/%n.ctr-id\nExecStopPost=/usr/bin/podman rm -f --ignore --cidfile=%t/%n.ctr-id\n[Install]\nWantedBy=multi-user.target\n"),
 			},
 		},
 		{
@@ -108,7 +110,7 @@ func TestIronicAgentService(t *testing.T) {
 			want: ignition_config_types_32.Unit{
 				Name:     "ironic-agent.service",
 				Enabled:  pointer.Bool(true),
-				Contents: pointer.String("[Unit]\nDescription=Ironic Agent\nAfter=network-online.target\nWants=network-online.target\n[Service]\nEnvironment=\"HTTP_PROXY=\"\nEnvironment=\"HTTPS_PROXY=\"\nEnvironment=\"NO_PROXY=\"\nTimeoutStartSec=0\nRestart=on-failure\nRestartSec=5\nStartLimitIntervalSec=0\nType=notify\nExecStartPre=/bin/rm -f %t/%n.ctr-id\nExecStart=/bin/podman run --detach --cgroups=no-conmon --sdnotify=conmon --rm --cidfile=%t/%n.ctr-id --privileged --network host --mount type=bind,src=/etc/ironic-python-agent.conf,dst=/etc/ironic-python-agent/ignition.conf --mount type=bind,src=/dev,dst=/dev --mount type=bind,src=/sys,dst=/sys --mount type=bind,src=/run/dbus/system_bus_socket,dst=/run/dbus/system_bus_socket --mount type=bind,src=/,dst=/mnt/coreos --mount type=bind,src=/run/udev,dst=/run/udev --ipc=host --uts=host --env \"IPA_COREOS_IP_OPTIONS=ip=dhcp6\" --env IPA_COREOS_COPY_NETWORK=true --env \"IPA_DEFAULT_HOSTNAME=my-host\" --tls-verify=false --authfile=/etc/authfile.json --name ironic-agent http://example.com/foo:latest\nExecStop=/usr/bin/podman stop --ignore --cidfile=%t/%n.ctr-id\nExecStopPost=/usr/bin/podman rm -f --ignore --cidfile=%t/%n.ctr-id\n[Install]\nWantedBy=multi-user.target\n"),
+				Contents: pointer.String("[Unit]\nDescription=Ironic Agent\nAfter=network-online.target\nWants=network-online.target\n[Service]\nTimeoutStartSec=0\nRestart=on-failure\nRestartSec=5\nStartLimitIntervalSec=0\nType=notify\nExecStartPre=/bin/rm -f %t/%n.ctr-id\nExecStart=/bin/podman run --detach --cgroups=no-conmon --sdnotify=conmon --rm --cidfile=%t/%n.ctr-id --privileged --network host --mount type=bind,src=/etc/ironic-python-agent.conf,dst=/etc/ironic-python-agent/ignition.conf --mount type=bind,src=/dev,dst=/dev --mount type=bind,src=/sys,dst=/sys --mount type=bind,src=/run/dbus/system_bus_socket,dst=/run/dbus/system_bus_socket --mount type=bind,src=/,dst=/mnt/coreos --mount type=bind,src=/run/udev,dst=/run/udev --ipc=host --uts=host --env \"IPA_COREOS_IP_OPTIONS=ip=dhcp6\" --env IPA_COREOS_COPY_NETWORK=true --env \"IPA_DEFAULT_HOSTNAME=my-host\" --tls-verify=false --authfile=/etc/authfile.json --name ironic-agent http://example.com/foo:latest\nExecStop=/usr/bin/podman stop --ignore --cidfile=%t/%n.ctr-id\nExecStopPost=/usr/bin/podman rm -f --ignore --cidfile=%t/%n.ctr-id\n[Install]\nWantedBy=multi-user.target\n"),
 			},
 		},
 	}
@@ -177,3 +179,492 @@ func TestProcessURLs(t *testing.T) {
 		})
 	}
 }
+
+func TestIronicAgentConfInspectionDHCPAllInterfaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:  "enabled",
+			value: "true",
+			want:  "inspection_dhcp_all_interfaces%20%3D%20True%0A",
+		},
+		{
+			name:  "disabled",
+			value: "false",
+			want:  "inspection_dhcp_all_interfaces%20%3D%20False%0A",
+		},
+		{
+			name:    "invalid",
+			value:   "sometimes",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &ignitionBuilder{ironicBaseURL: "http://example.com"}
+			err := b.SetInspectionDHCPAllInterfaces(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			got := *b.IronicAgentConf("").Contents.Source
+			if tt.want == "" {
+				assert.NotContains(t, got, "inspection_dhcp_all_interfaces")
+			} else {
+				assert.True(t, strings.HasSuffix(got, tt.want), got)
+			}
+		})
+	}
+}
+
+func TestIronicAgentConfCollectLLDP(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:  "enabled",
+			value: "true",
+			want:  "collect_lldp%20%3D%20True%0A",
+		},
+		{
+			name:  "disabled",
+			value: "false",
+			want:  "collect_lldp%20%3D%20False%0A",
+		},
+		{
+			name:    "invalid",
+			value:   "maybe",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &ignitionBuilder{ironicBaseURL: "http://example.com"}
+			err := b.SetCollectLLDP(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			got := *b.IronicAgentConf("").Contents.Source
+			if tt.want == "" {
+				assert.NotContains(t, got, "collect_lldp")
+			} else {
+				assert.True(t, strings.HasSuffix(got, tt.want), got)
+			}
+		})
+	}
+}
+
+func TestIronicAgentConfInspectionBenchmarks(t *testing.T) {
+	tests := []struct {
+		name       string
+		benchmarks string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:       "disabled",
+			benchmarks: "none",
+			want:       "inspection_benchmarks%20%3D%20%0A",
+		},
+		{
+			name:       "limited",
+			benchmarks: "cpu,mem",
+			want:       "inspection_benchmarks%20%3D%20cpu%2Cmem%0A",
+		},
+		{
+			name:       "invalid",
+			benchmarks: "cpu,gpu",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &ignitionBuilder{ironicBaseURL: "http://example.com"}
+			err := b.SetInspectionBenchmarks(tt.benchmarks)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			got := *b.IronicAgentConf("").Contents.Source
+			if tt.want == "" {
+				assert.NotContains(t, got, "inspection_benchmarks")
+			} else {
+				assert.True(t, strings.HasSuffix(got, tt.want), got)
+			}
+		})
+	}
+}
+
+func TestIronicAgentServiceTLSVerify(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		b := &ignitionBuilder{
+			ironicAgentImage: "http://example.com/foo:latest",
+		}
+		b.SetAgentImageTLSVerify(verify)
+		contents := *b.IronicAgentService(false).Contents
+		if verify {
+			assert.Contains(t, contents, " --tls-verify=true --name ironic-agent ")
+			assert.NotContains(t, contents, "--tls-verify=false")
+		} else {
+			assert.Contains(t, contents, " --tls-verify=false --name ironic-agent ")
+			assert.NotContains(t, contents, "--tls-verify=true")
+		}
+	}
+}
+
+func TestSetIPStack(t *testing.T) {
+	tests := []struct {
+		stack     string
+		ipOptions string
+		want      string
+		wantErr   bool
+	}{
+		{stack: "", ipOptions: "ip=dhcp6", want: "ip=dhcp6"},
+		{stack: "v4", want: "ip=dhcp"},
+		{stack: "v6", want: "ip=dhcp6"},
+		{stack: "dual", want: "ip=dhcp,dhcp6"},
+		{stack: "auto", want: ""},
+		{stack: "v5", wantErr: true},
+		{stack: "v4", ipOptions: "ip=dhcp6", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.stack+"/"+tt.ipOptions, func(t *testing.T) {
+			b := &ignitionBuilder{
+				ironicAgentImage: "http://example.com/foo:latest",
+				ipOptions:        tt.ipOptions,
+			}
+			err := b.SetIPStack(tt.stack)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Contains(t, *b.IronicAgentService(false).Contents,
+				"--env \"IPA_COREOS_IP_OPTIONS="+tt.want+"\"")
+		})
+	}
+}
+
+func TestIronicAgentServiceStartTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		arch     string
+		timeouts string
+		want     string
+		wantErr  bool
+	}{
+		{name: "default", arch: "x86_64", want: "TimeoutStartSec=0\n"},
+		{name: "seconds", arch: "aarch64", timeouts: "x86_64=300,aarch64=900", want: "TimeoutStartSec=900\n"},
+		{name: "duration", arch: "x86_64", timeouts: "x86_64=10m", want: "TimeoutStartSec=600\n"},
+		{name: "other-arch", arch: "ppc64le", timeouts: "x86_64=300", want: "TimeoutStartSec=0\n"},
+		{name: "no-arch", timeouts: "x86_64=300", want: "TimeoutStartSec=0\n"},
+		{name: "invalid", timeouts: "x86_64=soon", wantErr: true},
+		{name: "missing-arch", timeouts: "300", wantErr: true},
+		{name: "negative", timeouts: "x86_64=-5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &ignitionBuilder{
+				ironicAgentImage: "http://example.com/foo:latest",
+			}
+			b.SetArchitecture(tt.arch)
+			err := b.SetStartTimeouts(tt.timeouts)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Contains(t, *b.IronicAgentService(false).Contents, "\n"+tt.want)
+		})
+	}
+}
+
+func TestIronicAgentServiceDefaultStartTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		arch     string
+		timeout  time.Duration
+		timeouts string
+		want     string
+		wantErr  bool
+	}{
+		{name: "unset", want: "TimeoutStartSec=0\n"},
+		{name: "set", timeout: 15 * time.Minute, want: "TimeoutStartSec=900\n"},
+		{name: "overridden", arch: "aarch64", timeout: 15 * time.Minute, timeouts: "aarch64=30m", want: "TimeoutStartSec=1800\n"},
+		{name: "other-arch", arch: "x86_64", timeout: 15 * time.Minute, timeouts: "aarch64=30m", want: "TimeoutStartSec=900\n"},
+		{name: "negative", timeout: -time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &ignitionBuilder{
+				ironicAgentImage: "http://example.com/foo:latest",
+			}
+			b.SetArchitecture(tt.arch)
+			err := b.SetStartTimeout(tt.timeout)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NoError(t, b.SetStartTimeouts(tt.timeouts))
+			assert.Contains(t, *b.IronicAgentService(false).Contents, "\n"+tt.want)
+		})
+	}
+}
+
+func TestIronicAgentServiceArchitecture(t *testing.T) {
+	tests := []struct {
+		arch string
+		want string
+	}{
+		{arch: "", want: " --tls-verify=false --name ironic-agent "},
+		{arch: "x86_64", want: " --tls-verify=false --name ironic-agent "},
+		{arch: "aarch64", want: " --tls-verify=false --arch=arm64 --name ironic-agent "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arch, func(t *testing.T) {
+			b := &ignitionBuilder{
+				ironicAgentImage: "http://example.com/foo:latest",
+			}
+			b.SetArchitecture(tt.arch)
+			assert.Contains(t, *b.IronicAgentService(false).Contents, tt.want)
+		})
+	}
+}
+
+func TestIronicAgentServiceRestartPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{policy: "", want: "\nRestart=on-failure\n"},
+		{policy: "on-failure", want: "\nRestart=on-failure\n"},
+		{policy: "always", want: "\nRestart=always\n"},
+		{policy: "sometimes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			b := &ignitionBuilder{
+				ironicAgentImage: "http://example.com/foo:latest",
+			}
+			err := b.SetRestartPolicy(tt.policy)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Contains(t, *b.IronicAgentService(false).Contents, tt.want)
+		})
+	}
+}
+
+func TestIronicAgentServiceContainerName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "", want: " --name ironic-agent "},
+		{name: "ipa", want: " --name ipa "},
+		{name: "-ipa", wantErr: true},
+		{name: "ipa agent", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &ignitionBuilder{
+				ironicAgentImage: "http://example.com/foo:latest",
+			}
+			err := b.SetContainerName(tt.name)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Contains(t, *b.IronicAgentService(false).Contents, tt.want)
+		})
+	}
+}
+
+func TestIronicAgentServiceExtraMounts(t *testing.T) {
+	tests := []struct {
+		name    string
+		mounts  []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "none",
+			mounts: nil,
+			want:   "--mount type=bind,src=/run/udev,dst=/run/udev --ipc=host",
+		},
+		{
+			name:   "one",
+			mounts: []string{"/opt/firmware:/opt/fw"},
+			want:   "--mount type=bind,src=/run/udev,dst=/run/udev --mount type=bind,src=/opt/firmware,dst=/opt/fw --ipc=host",
+		},
+		{name: "no destination", mounts: []string{"/opt/firmware"}, wantErr: true},
+		{name: "relative", mounts: []string{"opt/firmware:/opt/fw"}, wantErr: true},
+		{name: "comma", mounts: []string{"/opt/a,ro:/opt/fw"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &ignitionBuilder{
+				ironicAgentImage: "http://example.com/foo:latest",
+			}
+			err := b.SetExtraMounts(tt.mounts)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Contains(t, *b.IronicAgentService(false).Contents, tt.want)
+		})
+	}
+}
+
+func TestIronicAgentServiceExtraEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		agentEnv map[string]string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "none",
+			want: `--env "IPA_DEFAULT_HOSTNAME=" --tls-verify`,
+		},
+		{
+			name: "two",
+			agentEnv: map[string]string{
+				"IPA_ENABLE_PROFILER": "true",
+				"IPA_DEBUG":           "1",
+			},
+			want: `--env "IPA_DEFAULT_HOSTNAME=" --env "IPA_DEBUG=1" --env "IPA_ENABLE_PROFILER=true" --tls-verify`,
+		},
+		{name: "invalid name", agentEnv: map[string]string{"IPA-DEBUG": "1"}, wantErr: true},
+		{name: "quote", agentEnv: map[string]string{"IPA_DEBUG": `1" --privileged`}, wantErr: true},
+		{name: "variable", agentEnv: map[string]string{"IPA_DEBUG": "$HOME"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &ignitionBuilder{
+				ironicAgentImage: "http://example.com/foo:latest",
+			}
+			err := b.SetExtraAgentEnv(tt.agentEnv)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Contains(t, *b.IronicAgentService(false).Contents, tt.want)
+
+			// The order must not depend on map iteration.
+			for i := 0; i < 10; i++ {
+				assert.NoError(t, b.SetExtraAgentEnv(tt.agentEnv))
+				assert.Contains(t, *b.IronicAgentService(false).Contents, tt.want)
+			}
+		})
+	}
+}
+
+func TestIronicAgentServiceDefaultIPOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		ipOptions string
+		stack     string
+		defaults  *string
+		want      string
+	}{
+		{name: "default", want: "ip=dhcp,dhcp6"},
+		{name: "explicit", ipOptions: "ip=dhcp6", want: "ip=dhcp6"},
+		{name: "stack", stack: "v4", want: "ip=dhcp"},
+		{name: "auto", stack: "auto", want: ""},
+		{name: "configured default", defaults: pointer.String("ip=dhcp"), want: "ip=dhcp"},
+		{name: "no default", defaults: pointer.String(""), want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := New(nil, nil,
+				"http://ironic.example.com", "",
+				"quay.io/openshift-release-dev/ironic-ipa-image",
+				"", "", tt.ipOptions, "", "", "", "", "", []string{})
+			assert.NoError(t, err)
+			assert.NoError(t, b.SetIPStack(tt.stack))
+			if tt.defaults != nil {
+				b.SetDefaultIPOptions(*tt.defaults)
+			}
+			assert.Contains(t, *b.IronicAgentService(false).Contents,
+				"--env \"IPA_COREOS_IP_OPTIONS="+tt.want+"\"")
+		})
+	}
+}
+
+func TestValidatePullSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			secret: "eyJhdXRocyI6eyJxdWF5LmlvIjp7ImF1dGgiOiJabTl2T21KaGNnPT0ifX19", // {"auths":{"quay.io":{"auth":"Zm9vOmJhcg=="}}}
+		},
+		{
+			name:   "empty auths",
+			secret: " eyJhdXRocyI6e319\n", // {"auths":{}}
+		},
+		{
+			name:    "not base64",
+			secret:  "not base64!",
+			wantErr: "pull secret is not valid base64",
+		},
+		{
+			name:    "not JSON",
+			secret:  "cHVsbCBzZWNyZXQ=", // pull secret
+			wantErr: "pull secret is not valid docker config JSON",
+		},
+		{
+			name:    "no auths",
+			secret:  "eyJmb28iOiJiYXIifQ==", // {"foo":"bar"}
+			wantErr: "pull secret has no \"auths\" section",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePullSecret(tt.secret)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorAs(t, err, &InvalidConfigError{})
+			assert.ErrorContains(t, err, tt.wantErr)
+
+			_, err = New(nil, nil, "http://example.com", "", "quay.io/ironic-agent", tt.secret, "", "", "", "", "", "", "", nil)
+			assert.ErrorAs(t, err, &InvalidConfigError{})
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package ignition
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/openshift/image-customization-controller/pkg/env"
+)
+
+// errRegistriesRequired is returned when building the ignition of a host
+// without a registries.conf, if one is required.
+var errRegistriesRequired = errors.New("registries.conf is required but empty")
+
+// Template holds an ignition builder configured from the environment, which
+// is copied for each host. The settings shared by all hosts are read and
+// validated once, when the template is created, rather than for every image.
+type Template struct {
+	builder *ignitionBuilder
+	// registriesMissing is set if a registries.conf is required but empty.
+	// It is reported for each host rather than when the template is created,
+	// so that it appears in the status of their images.
+	registriesMissing bool
+}
+
+// NewTemplate returns a Template configured from inputs. The pull secret is
+// passed separately, as it may be read from a mounted secret rather than the
+// environment.
+func NewTemplate(inputs *env.EnvInputs, pullSecret string) (*Template, error) {
+	registries, err := inputs.RegistriesConf()
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := inputs.IronicCACert()
+	if err != nil {
+		return nil, err
+	}
+
+	clientCert, clientKey, err := inputs.IronicClientCert()
+	if err != nil {
+		return nil, err
+	}
+
+	trustBundle, err := inputs.TrustBundle()
+	if err != nil {
+		return nil, err
+	}
+
+	additionalNTPServers := []string{}
+	if inputs.AdditionalNTPServers != "" {
+		additionalNTPServers = strings.Split(inputs.AdditionalNTPServers, ",")
+	}
+
+	b, err := New(nil, registries,
+		inputs.IronicBaseURL,
+		inputs.IronicInspectorBaseURL,
+		inputs.IronicAgentImage,
+		pullSecret,
+		inputs.IronicRAMDiskSSHKey,
+		inputs.IpOptions,
+		inputs.HttpProxy,
+		inputs.HttpsProxy,
+		inputs.NoProxy,
+		"",
+		inputs.IronicAgentVlanInterfaces,
+		additionalNTPServers,
+	)
+	if err != nil {
+		return nil, err
+	}
+	b.SetIronicTLS(inputs.InsecureIronicTLS, caCert)
+	if err := b.SetIronicClientCert(clientCert, clientKey); err != nil {
+		return nil, err
+	}
+	b.SetTrustBundle(trustBundle)
+	b.SetAgentImageTLSVerify(inputs.IronicAgentTLSVerify)
+	b.SetCompressRegistriesConf(inputs.CompressRegistriesConf)
+	b.SetLoginBanner(inputs.LoginBanner)
+	b.SetDefaultIPOptions(inputs.DefaultIPOptions)
+	b.SetNMStatectlTimeout(inputs.NMStatectlTimeout)
+	if err := b.SetPasswordLogin(inputs.RAMDiskPasswordLogin, inputs.RAMDiskPasswordHash); err != nil {
+		return nil, err
+	}
+	if err := b.SetRegistriesPath(inputs.RegistriesConfTarget); err != nil {
+		return nil, err
+	}
+	if err := b.SetRegistriesMode(inputs.RegistriesConfMode); err != nil {
+		return nil, err
+	}
+	if err := b.SetExtraFilesDir(inputs.ExtraIgnitionFilesDir); err != nil {
+		return nil, err
+	}
+	if err := b.SetExtraFilesOwner(inputs.ExtraIgnitionFilesOwner); err != nil {
+		return nil, err
+	}
+	if err := b.SetOverridesDir(inputs.IgnitionOverridesDir); err != nil {
+		return nil, err
+	}
+	if err := b.SetInspectionBenchmarks(inputs.InspectionBenchmarks); err != nil {
+		return nil, err
+	}
+	if err := b.SetInspectionDHCPAllInterfaces(inputs.InspectionDHCPAll); err != nil {
+		return nil, err
+	}
+	if err := b.SetCollectLLDP(inputs.CollectLLDP); err != nil {
+		return nil, err
+	}
+	if err := b.SetIPStack(inputs.IPStack); err != nil {
+		return nil, err
+	}
+	if err := b.SetKeyFilesDir(inputs.NetworkKeyFilesDir); err != nil {
+		return nil, err
+	}
+	if err := b.SetDNSServers(inputs.DNSServers); err != nil {
+		return nil, err
+	}
+	if err := b.SetHostnameDomain(inputs.HostnameDomain); err != nil {
+		return nil, err
+	}
+	if err := b.SetRemoteSyslog(inputs.RemoteSyslogServer); err != nil {
+		return nil, err
+	}
+	if err := b.SetJournal(inputs.JournalStorage, inputs.JournalMaxUse); err != nil {
+		return nil, err
+	}
+	if err := b.SetRestartPolicy(inputs.IronicAgentRestartPolicy); err != nil {
+		return nil, err
+	}
+	if err := b.SetContainerName(inputs.IronicAgentContainerName); err != nil {
+		return nil, err
+	}
+	if err := b.SetExtraMounts(inputs.IronicAgentExtraMounts); err != nil {
+		return nil, err
+	}
+	if err := b.SetExtraAgentEnv(inputs.IronicAgentExtraEnv); err != nil {
+		return nil, err
+	}
+	if err := b.SetDefaultEnv(inputs.DefaultEnv); err != nil {
+		return nil, err
+	}
+	if err := b.SetStartTimeout(inputs.IronicAgentStartTimeout); err != nil {
+		return nil, err
+	}
+	if err := b.SetStartTimeouts(inputs.IronicAgentStartTimeouts); err != nil {
+		return nil, err
+	}
+	if err := b.SetReregister(inputs.AgentReregister, inputs.ReregisterInterval); err != nil {
+		return nil, err
+	}
+	return &Template{
+		builder:           b,
+		registriesMissing: inputs.RequireRegistries && len(bytes.TrimSpace(registries)) == 0,
+	}, nil
+}
+
+// Builder returns a builder for the ignition of a host, from the template
+// with the given network state, hostname and architecture. It returns an
+// error if no ignition can be built because a required registries.conf is
+// empty.
+func (t *Template) Builder(nmStateData []byte, hostname, arch string) (*ignitionBuilder, error) {
+	if t.registriesMissing {
+		return nil, errRegistriesRequired
+	}
+	b := *t.builder
+	b.nmStateData = nmStateData
+	b.hostname = hostname
+	b.architecture = arch
+	return &b, nil
+}
@@ -0,0 +1,69 @@
+package ignition
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openshift/image-customization-controller/pkg/env"
+)
+
+func TestTemplateBuilder(t *testing.T) {
+	template, err := NewTemplate(&env.EnvInputs{
+		IronicBaseURL:     "http://ironic.example.com",
+		IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+		InsecureIronicTLS: true,
+		HostnameDomain:    "example.com",
+	}, "")
+	assert.NoError(t, err)
+
+	first, err := template.Builder([]byte("interfaces: []"), "first", "x86_64")
+	assert.NoError(t, err)
+	second, err := template.Builder(nil, "second", "aarch64")
+	assert.NoError(t, err)
+
+	assert.Equal(t, "first.example.com", first.fqdn())
+	assert.Equal(t, "second.example.com", second.fqdn())
+	assert.Equal(t, "x86_64", first.architecture)
+	assert.Equal(t, "aarch64", second.architecture)
+	assert.Nil(t, second.nmStateData)
+	assert.Empty(t, template.builder.hostname)
+}
+
+func TestNewTemplateInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		inputs env.EnvInputs
+	}{
+		{
+			name:   "missing Ironic URL",
+			inputs: env.EnvInputs{IronicAgentImage: "quay.io/ironic-agent"},
+		},
+		{
+			name: "invalid restart policy",
+			inputs: env.EnvInputs{
+				IronicBaseURL:            "http://ironic.example.com",
+				IronicAgentImage:         "quay.io/ironic-agent",
+				IronicAgentRestartPolicy: "sometimes",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTemplate(&tt.inputs, "")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTemplateRequireRegistries(t *testing.T) {
+	template, err := NewTemplate(&env.EnvInputs{
+		IronicBaseURL:     "http://ironic.example.com",
+		IronicAgentImage:  "quay.io/ironic-agent",
+		RequireRegistries: true,
+	}, "")
+	assert.NoError(t, err)
+
+	_, err = template.Builder(nil, "host", "x86_64")
+	assert.ErrorIs(t, err, errRegistriesRequired)
+}
@@ -1,42 +1,172 @@
 package imagehandler
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"sync"
 
 	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+	"github.com/openshift/assisted-image-service/pkg/overlay"
 )
 
+// fcosIgnitionImagePath is the location of the ignition embed area in a
+// Fedora CoreOS live ISO.
+const fcosIgnitionImagePath = "/images/ignition.img"
+
 type baseFile interface {
+	Path() string
+	Available() error
 	Size() (int64, error)
-	InsertIgnition(*isoeditor.IgnitionContent) (isoeditor.ImageReader, error)
+	Checksum() (string, error)
+	InsertIgnition(ignition *isoeditor.IgnitionContent, kargs []string) (isoeditor.ImageReader, error)
 }
 
 type baseFileData struct {
 	filename string
 	size     int64
+	checksum string
+	mu       sync.Mutex
+	// checksumMu serializes computing the checksum, without holding mu
+	// while the file is read.
+	checksumMu sync.Mutex
+}
+
+// Path returns the location of the file.
+func (bf *baseFileData) Path() string {
+	return bf.filename
+}
+
+// Available returns an error if the file is missing, e.g. because the volume
+// holding it has been remounted.
+func (bf *baseFileData) Available() error {
+	if _, err := os.Stat(bf.filename); err != nil {
+		return fmt.Errorf("base image %s is unavailable: %w", bf.filename, err)
+	}
+	return nil
+}
+
+// checkReadable returns an error unless the start of the file can be read,
+// which fails for files on a volume that is no longer mounted properly.
+func (bf *baseFileData) checkReadable() error {
+	f, err := os.Open(bf.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("failed to read base image %s: %w", bf.filename, err)
+	}
+	return nil
 }
 
 func (bf *baseFileData) Size() (int64, error) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
 	if bf.size == 0 {
 		fi, err := os.Stat(bf.filename)
 		if err != nil {
-			return 0, err
+			return 0, fmt.Errorf("base image %s is unavailable: %w", bf.filename, err)
 		}
 		bf.size = fi.Size()
 	}
 	return bf.size, nil
 }
 
+// Checksum returns the SHA256 checksum of the file, reading it in full on
+// first use.
+func (bf *baseFileData) Checksum() (string, error) {
+	bf.checksumMu.Lock()
+	defer bf.checksumMu.Unlock()
+
+	bf.mu.Lock()
+	checksum := bf.checksum
+	bf.mu.Unlock()
+	if checksum != "" {
+		return checksum, nil
+	}
+
+	f, err := os.Open(bf.filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	checksum = hex.EncodeToString(hash.Sum(nil))
+
+	bf.mu.Lock()
+	bf.checksum = checksum
+	bf.mu.Unlock()
+	return checksum, nil
+}
+
 type baseIso struct {
 	baseFileData
+	fcos bool
 }
 
 func newBaseIso(filename string) *baseIso {
-	return &baseIso{baseFileData{filename: filename}}
+	return &baseIso{baseFileData: baseFileData{filename: filename}}
+}
+
+func newBaseFCOSIso(filename string) *baseIso {
+	return &baseIso{baseFileData: baseFileData{filename: filename}, fcos: true}
+}
+
+func (biso *baseIso) InsertIgnition(ignition *isoeditor.IgnitionContent, kargs []string) (isoeditor.ImageReader, error) {
+	if biso.fcos {
+		if len(kargs) > 0 {
+			return nil, errFCOSKargs
+		}
+		return newFCOSStreamReader(biso.filename, ignition)
+	}
+	return isoeditor.NewRHCOSStreamReader(biso.filename, ignition, nil, isoKargs(kargs))
 }
 
-func (biso *baseIso) InsertIgnition(ignition *isoeditor.IgnitionContent) (isoeditor.ImageReader, error) {
-	return isoeditor.NewRHCOSStreamReader(biso.filename, ignition, nil, nil)
+// errFCOSKargs is returned when adding kernel arguments to a Fedora CoreOS
+// ISO, whose layout is not assumed beyond its ignition embed area.
+var errFCOSKargs = errors.New("kernel arguments cannot be added to a Fedora CoreOS base image")
+
+// newFCOSStreamReader returns a stream of the Fedora CoreOS ISO at isoPath with
+// the ignition written to its embed area. Unlike the RHCOS stream reader, it
+// makes no other assumptions about the layout of the ISO.
+func newFCOSStreamReader(isoPath string, ignition *isoeditor.IgnitionContent) (isoeditor.ImageReader, error) {
+	offset, length, err := isoeditor.GetISOFileInfo(fcosIgnitionImagePath, isoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ignition.Archive()
+	if err != nil {
+		return nil, err
+	}
+	if content.Size() > length {
+		return nil, fmt.Errorf("ignition size (%d) exceeds embed area size (%d)", content.Size(), length)
+	}
+
+	isoReader, err := os.Open(isoPath)
+	if err != nil {
+		return nil, err
+	}
+	r, err := overlay.NewOverlayReader(isoReader, overlay.Overlay{
+		Reader: content,
+		Offset: offset,
+		Length: content.Size(),
+	})
+	if err != nil {
+		isoReader.Close()
+		return nil, err
+	}
+	return r, nil
 }
 
 type baseInitramfs struct {
@@ -47,6 +177,8 @@ func newBaseInitramfs(filename string) *baseInitramfs {
 	return &baseInitramfs{baseFileData{filename: filename}}
 }
 
-func (birfs *baseInitramfs) InsertIgnition(ignition *isoeditor.IgnitionContent) (isoeditor.ImageReader, error) {
+// InsertIgnition appends the ignition to the initramfs. The kernel arguments
+// of an initramfs are served separately, by openKargs.
+func (birfs *baseInitramfs) InsertIgnition(ignition *isoeditor.IgnitionContent, kargs []string) (isoeditor.ImageReader, error) {
 	return isoeditor.NewInitRamFSStreamReader(birfs.filename, ignition)
 }
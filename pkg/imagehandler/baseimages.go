@@ -0,0 +1,263 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package imagehandler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// hostArchitecture is the key used for base images whose filename does not
+// specify an architecture. They are used for any architecture that has no
+// image of its own.
+const hostArchitecture = "host"
+
+// archNames maps the Go and Debian style names of architectures to the names
+// used by RHCOS, which are also those reported in a host's hardware details.
+var archNames = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+}
+
+// normalizeArch returns the RHCOS name of an architecture, e.g. x86_64 for
+// amd64. Names that are already canonical are returned unchanged.
+func normalizeArch(arch string) string {
+	if name, exists := archNames[arch]; exists {
+		return name
+	}
+	return arch
+}
+
+// hostArchitectureName returns the name of the architecture the controller is
+// running on, as reported in a host's hardware details.
+func hostArchitectureName() string {
+	return normalizeArch(runtime.GOARCH)
+}
+
+// parseArchAliases parses a comma delimited list of alias=arch pairs, each
+// making the base images of arch available for hosts of the alias
+// architecture.
+func parseArchAliases(aliases string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, entry := range strings.Split(aliases, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		alias, arch, found := strings.Cut(entry, "=")
+		if !found || alias == "" || arch == "" {
+			return nil, fmt.Errorf("invalid architecture alias %q, expected alias=arch", entry)
+		}
+		alias, arch = normalizeArch(alias), normalizeArch(arch)
+		if alias == arch {
+			return nil, fmt.Errorf("architecture %q cannot be an alias of itself", alias)
+		}
+		result[alias] = arch
+	}
+	return result, nil
+}
+
+// ironicImageRegexp matches the names of base images. Images built from
+// Fedora CoreOS rather than RHCOS carry an -fcos suffix on the prefix, e.g.
+// ironic-python-agent-fcos.x86_64.iso.
+var ironicImageRegexp = regexp.MustCompile(`^ironic-python-agent(-fcos)?(?:\.(\w+))?\.(iso|initramfs)$`)
+
+// parseIronicImage returns the architecture and file type (iso or initramfs)
+// encoded in the name of a base image file, and whether it is a Fedora CoreOS
+// image.
+func parseIronicImage(filename string) (arch, fileType string, fcos, ok bool) {
+	match := ironicImageRegexp.FindStringSubmatch(filename)
+	if match == nil {
+		return "", "", false, false
+	}
+	arch = normalizeArch(match[2])
+	if arch == "" {
+		arch = hostArchitecture
+	}
+	return arch, match[3], match[1] != "", true
+}
+
+// baseImageSet is a collection of base images, keyed by architecture.
+type baseImageSet struct {
+	isoFiles       map[string]*baseIso
+	initramfsFiles map[string]*baseInitramfs
+}
+
+func newBaseImageSet() *baseImageSet {
+	return &baseImageSet{
+		isoFiles:       map[string]*baseIso{},
+		initramfsFiles: map[string]*baseInitramfs{},
+	}
+}
+
+// duplicateBaseImageError reports a base image that was ignored because
+// another file provides the image of the same architecture and type.
+type duplicateBaseImageError struct {
+	arch, fileType string
+	used, ignored  string
+}
+
+func (e duplicateBaseImageError) Error() string {
+	return fmt.Sprintf("ignoring base image %s, as %s is already the %s %s image",
+		e.ignored, e.used, e.arch, e.fileType)
+}
+
+// addFile adds the base image in dir with the given filename to the set,
+// unless the name is not recognised or the set already has an image of the
+// same architecture and type. In the latter case, a duplicateBaseImageError is
+// returned if the existing image is a different file.
+func (s *baseImageSet) addFile(dir, filename string) error {
+	arch, fileType, fcos, ok := parseIronicImage(filename)
+	if !ok {
+		return nil
+	}
+	path := filepath.Join(dir, filename)
+	used := ""
+	switch fileType {
+	case "iso":
+		if existing, exists := s.isoFiles[arch]; exists {
+			used = existing.filename
+		} else if fcos {
+			s.isoFiles[arch] = newBaseFCOSIso(path)
+		} else {
+			s.isoFiles[arch] = newBaseIso(path)
+		}
+	case "initramfs":
+		if existing, exists := s.initramfsFiles[arch]; exists {
+			used = existing.filename
+		} else {
+			s.initramfsFiles[arch] = newBaseInitramfs(path)
+		}
+	}
+	if used != "" && filepath.Clean(used) != path {
+		return duplicateBaseImageError{arch: arch, fileType: fileType, used: used, ignored: path}
+	}
+	return nil
+}
+
+func (s *baseImageSet) getBaseImage(arch string, initramfs bool) baseFile {
+	if initramfs {
+		if file, exists := s.initramfsFiles[arch]; exists {
+			return file
+		}
+	} else {
+		if file, exists := s.isoFiles[arch]; exists {
+			return file
+		}
+	}
+	return nil
+}
+
+// hasArchitecture returns whether the set has a base image for arch that is
+// currently available, so that one that has gone missing is not counted.
+func (s *baseImageSet) hasArchitecture(arch string) bool {
+	if iso, exists := s.isoFiles[arch]; exists && iso.Available() == nil {
+		return true
+	}
+	if initramfs, exists := s.initramfsFiles[arch]; exists && initramfs.Available() == nil {
+		return true
+	}
+	return false
+}
+
+func (s *baseImageSet) empty() bool {
+	return len(s.isoFiles) == 0 && len(s.initramfsFiles) == 0
+}
+
+// loadBaseImages indexes the base images in dir. Images directly in dir are
+// added to defaults, while each subdirectory holds the images for the release
+// version it is named after. Subdirectories that cannot be read are skipped
+// with a warning, and those without base images are ignored, so that
+// unrelated content in dir does not prevent the rest from being served. Any
+// base images ignored because another file provides the same image are
+// returned as duplicateBaseImageErrors.
+func loadBaseImages(log logr.Logger, dir string, defaults *baseImageSet, versions map[string]*baseImageSet) ([]error, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	duplicates := []error{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			if err := defaults.addFile(dir, entry.Name()); err != nil {
+				duplicates = append(duplicates, err)
+			}
+			continue
+		}
+
+		versionDir := filepath.Join(dir, entry.Name())
+		files, err := os.ReadDir(versionDir)
+		if err != nil {
+			log.Info("skipping unreadable base image directory", "path", versionDir, "error", err.Error())
+			continue
+		}
+		set, exists := versions[entry.Name()]
+		if !exists {
+			set = newBaseImageSet()
+		}
+		for _, file := range files {
+			if !file.IsDir() {
+				if err := set.addFile(versionDir, file.Name()); err != nil {
+					duplicates = append(duplicates, err)
+				}
+			}
+		}
+		if !set.empty() {
+			versions[entry.Name()] = set
+		}
+	}
+	return duplicates, nil
+}
+
+// compareVersions orders release versions such as 4.9 and 4.14, comparing
+// each dot-separated component numerically where possible.
+func compareVersions(a, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aNum, aErr := strconv.Atoi(aParts[i])
+		bNum, bErr := strconv.Atoi(bParts[i])
+		if aErr == nil && bErr == nil {
+			if aNum != bNum {
+				return aNum - bNum
+			}
+			continue
+		}
+		if c := strings.Compare(aParts[i], bParts[i]); c != 0 {
+			return c
+		}
+	}
+	return len(aParts) - len(bParts)
+}
+
+// sortedVersions returns the names of the available release versions, latest
+// first.
+func sortedVersions(versions map[string]*baseImageSet) []string {
+	names := make([]string, 0, len(versions))
+	for name := range versions {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return compareVersions(b, a)
+	})
+	return names
+}
@@ -0,0 +1,193 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package imagehandler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+)
+
+// checksumFormat is a format in which the SHA256 checksum of a served image
+// can be downloaded, at the image's URL with the suffix appended.
+type checksumFormat struct {
+	suffix string
+	render func(checksum, name string) string
+}
+
+var checksumFormats = map[string]checksumFormat{
+	// The bare hex digest.
+	"hex": {
+		suffix: ".sha256",
+		render: func(checksum, name string) string { return checksum + "\n" },
+	},
+	// The hex digest prefixed with the algorithm name.
+	"prefixed": {
+		suffix: ".digest",
+		render: func(checksum, name string) string { return "sha256:" + checksum + "\n" },
+	},
+	// The output format of sha256sum.
+	"sum": {
+		suffix: ".sha256sum",
+		render: func(checksum, name string) string { return fmt.Sprintf("%s  %s\n", checksum, name) },
+	},
+}
+
+func parseChecksumFormats(formats string) ([]checksumFormat, error) {
+	result := []checksumFormat{}
+	for _, name := range strings.Split(formats, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		format, exists := checksumFormats[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown checksum format %q", name)
+		}
+		result = append(result, format)
+	}
+	return result, nil
+}
+
+// imageChecksum returns the SHA256 checksum of the image, computing it from a
+// separate stream on first use.
+func (f *imageFileSystem) imageChecksum(im *imageFile) (string, error) {
+	f.mu.Lock()
+	checksum := im.checksum
+	f.mu.Unlock()
+	if checksum != "" {
+		return checksum, nil
+	}
+
+	baseImage := f.getBaseImage(im.arch, im.version, im.initramfs)
+	if baseImage == nil {
+		return "", fs.ErrNotExist
+	}
+	reader, err := baseImage.InsertIgnition(&isoeditor.IgnitionContent{Config: im.embeddedIgnition()}, im.kargs)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	checksum = hex.EncodeToString(hash.Sum(nil))
+
+	f.mu.Lock()
+	im.checksum = checksum
+	f.mu.Unlock()
+	return checksum, nil
+}
+
+// imageDigest returns a SHA256 digest identifying the content of an image,
+// derived from the checksum of its base image, a hash of its ignition content
+// and any kernel arguments added, rather than from the whole image, which is
+// far cheaper to compute.
+func imageDigest(baseChecksum string, ignitionContent []byte, kargs []string) string {
+	ignitionHash := sha256.Sum256(ignitionContent)
+	input := baseChecksum + hex.EncodeToString(ignitionHash[:])
+	if len(kargs) > 0 {
+		input += " " + strings.Join(kargs, " ")
+	}
+	hash := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(hash[:])
+}
+
+// imageETag returns the entity tag of the image, derived from the size and
+// modification time of its base image and a hash of its ignition content and
+// kernel arguments. Unlike the checksum of the base image, these are cheap to
+// get, so the first request for an image is not held up while a large ISO is
+// read in full. Since an image is replaced whenever its ignition changes, the
+// hash is only computed once for each.
+func (f *imageFileSystem) imageETag(im *imageFile) (string, error) {
+	baseImage := f.getBaseImage(im.arch, im.version, im.initramfs)
+	if baseImage == nil {
+		return "", fs.ErrNotExist
+	}
+	fi, err := os.Stat(baseImage.Path())
+	if err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	contentDigest := im.contentDigest
+	f.mu.Unlock()
+	if contentDigest == "" {
+		contentDigest = imageDigest("", im.embeddedIgnition(), im.kargs)
+
+		f.mu.Lock()
+		im.contentDigest = contentDigest
+		f.mu.Unlock()
+	}
+	return fmt.Sprintf("\"%x-%x-%s\"", fi.Size(), fi.ModTime().UnixNano(), contentDigest), nil
+}
+
+// openChecksum returns the checksum file with the given name, if it is one.
+func (f *imageFileSystem) openChecksum(name string) (*textFile, error) {
+	for _, format := range f.checksumFormats {
+		if !strings.HasSuffix(name, format.suffix) {
+			continue
+		}
+		imageName := strings.TrimSuffix(name, format.suffix)
+		im := f.imageFileByName(imageName)
+		if im == nil {
+			return nil, fs.ErrNotExist
+		}
+		checksum, err := f.imageChecksum(im)
+		if err != nil {
+			return nil, err
+		}
+		return newTextFile(name, format.render(checksum, imageName)), nil
+	}
+	return nil, nil
+}
+
+// textFile is the http.File used to serve small generated files, such as
+// image checksums.
+type textFile struct {
+	*bytes.Reader
+	name string
+}
+
+func newTextFile(name, contents string) *textFile {
+	return &textFile{Reader: bytes.NewReader([]byte(contents)), name: name}
+}
+
+// file interface implementation
+
+var _ fs.File = &textFile{}
+
+func (f *textFile) Stat() (fs.FileInfo, error)               { return fs.FileInfo(f), nil }
+func (f *textFile) Close() error                             { return nil }
+func (f *textFile) Readdir(count int) ([]fs.FileInfo, error) { return []fs.FileInfo{}, nil }
+
+// fileInfo interface implementation
+
+var _ fs.FileInfo = &textFile{}
+
+func (f *textFile) Name() string       { return f.name }
+func (f *textFile) Mode() fs.FileMode  { return 0444 }
+func (f *textFile) ModTime() time.Time { return time.Now() }
+func (f *textFile) IsDir() bool        { return false }
+func (f *textFile) Sys() interface{}   { return nil }
@@ -0,0 +1,98 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package imagehandler
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressedISOSuffix is appended to the name of an ISO to request a
+// gzip-compressed copy of it.
+const compressedISOSuffix = ".gz"
+
+// compressedContentType is the Content-Type of compressed copies of ISOs.
+const compressedContentType = "application/gzip"
+
+// acceptsGzip reports whether the client of a request accepts gzip-encoded
+// responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			key, q, found := strings.Cut(strings.TrimSpace(params), "=")
+			if found && strings.TrimSpace(key) == "q" {
+				if weight, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gzipETag returns the entity tag of the gzip-encoded representation of an
+// image with the given entity tag, which differs from the unencoded one.
+func gzipETag(etag string) string {
+	if etag == "" {
+		return ""
+	}
+	return strings.TrimSuffix(etag, `"`) + `-gzip"`
+}
+
+// serveGzip serves an image compressed with gzip on the fly, either as its
+// Content-Encoding or as a compressed copy of the image. The size of the
+// response is not known in advance, so range requests are not supported and
+// the response is not given a Content-Length.
+func (f *imageFileSystem) serveGzip(w http.ResponseWriter, r *http.Request, im *imageFile, encoded bool) {
+	etag := gzipETag(w.Header().Get("ETag"))
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	file, err := f.Open(im.name)
+	if err != nil {
+		http.Error(w, "image not available", http.StatusServiceUnavailable)
+		return
+	}
+	defer file.Close()
+
+	if encoded {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, file); err != nil {
+		f.log.Error(err, "failed to serve compressed image", "name", im.name)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		f.log.Error(err, "failed to serve compressed image", "name", im.name)
+	}
+}
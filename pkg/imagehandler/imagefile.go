@@ -27,37 +27,52 @@ type imageFile struct {
 	name            string
 	size            int64
 	ignitionContent []byte
+	pointerIgnition []byte
+	kargs           []string
 	imageReader     isoeditor.ImageReader
+	arch            string
+	version         string
 	initramfs       bool
+	checksum        string
+	contentDigest   string
 }
 
 // file interface implementation
 
 var _ fs.File = &imageFile{}
 
+// embeddedIgnition returns the ignition config embedded in the image: either
+// the full config, or one referencing it if it is served remotely.
+func (f *imageFile) embeddedIgnition() []byte {
+	if f.pointerIgnition != nil {
+		return f.pointerIgnition
+	}
+	return f.ignitionContent
+}
+
 func (f *imageFile) Init(inputFile baseFile) error {
 	if f.imageReader != nil {
 		return nil
 	}
 
 	var err error
-	ignition := &isoeditor.IgnitionContent{Config: f.ignitionContent}
-	f.imageReader, err = inputFile.InsertIgnition(ignition)
+	ignition := &isoeditor.IgnitionContent{Config: f.embeddedIgnition()}
+	f.imageReader, err = inputFile.InsertIgnition(ignition, f.kargs)
+	if err != nil {
+		return err
+	}
+	// Take the size from the stream, which includes the ignition, so that
+	// the Content-Length is accurate. Some BMCs refuse chunked responses.
+	size, err := f.imageReader.Seek(0, io.SeekEnd)
 	if err != nil {
+		f.Close()
 		return err
 	}
-	if f.initramfs {
-		size, err := f.imageReader.Seek(0, io.SeekEnd)
-		if err != nil {
-			f.Close()
-			return err
-		}
-		f.size = size
-		_, err = f.imageReader.Seek(0, io.SeekStart)
-		if err != nil {
-			f.Close()
-			return err
-		}
+	f.size = size
+	_, err = f.imageReader.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return err
 	}
 	return nil
 }
@@ -52,11 +52,28 @@ func (f *imageFileSystem) Open(name string) (http.File, error) {
 		return f, nil
 	}
 
+	checksum, err := f.openChecksum(path.Base(name))
+	if err != nil {
+		f.log.Error(err, "failed to compute image checksum")
+		return nil, err
+	}
+	if checksum != nil {
+		return checksum, nil
+	}
+
+	if kargs := f.openKargs(path.Base(name)); kargs != nil {
+		return kargs, nil
+	}
+
 	im := f.imageFileByName(path.Base(name))
 	if im == nil {
 		return nil, fs.ErrNotExist
 	}
-	if err := im.Init(f.getBaseImage(im.initramfs)); err != nil {
+	baseImage := f.getBaseImage(im.arch, im.version, im.initramfs)
+	if baseImage == nil {
+		return nil, fs.ErrNotExist
+	}
+	if err := im.Init(baseImage); err != nil {
 		f.log.Error(err, "failed to create image stream")
 		return nil, err
 	}
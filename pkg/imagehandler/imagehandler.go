@@ -14,15 +14,32 @@ limitations under the License.
 package imagehandler
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/google/uuid"
+
+	"github.com/openshift/image-customization-controller/pkg/env"
 )
 
+var lookupHost = net.LookupHost
+
+// checksumConcurrency is the number of base images whose checksums are
+// computed at once when precomputing them.
+const checksumConcurrency = 2
+
 type InvalidBaseImageError struct {
 	cause error
 }
@@ -35,16 +52,48 @@ func (ie InvalidBaseImageError) Unwrap() error {
 	return ie.cause
 }
 
+// UnknownNetworkError is returned when an image is requested for a publish
+// network that has no URL configured.
+type UnknownNetworkError struct {
+	network string
+}
+
+func (ne UnknownNetworkError) Error() string {
+	return fmt.Sprintf("no publish URL for network %q", ne.network)
+}
+
+// IgnitionTooLargeError is returned when the ignition config for an image
+// exceeds the maximum size that can be embedded in it.
+type IgnitionTooLargeError struct {
+	size  int
+	limit int64
+}
+
+func (ie IgnitionTooLargeError) Error() string {
+	return fmt.Sprintf("ignition config of %d bytes exceeds the maximum of %d bytes", ie.size, ie.limit)
+}
+
 // imageFileSystem is an http.FileSystem that creates a virtual filesystem of
 // host images.
 type imageFileSystem struct {
-	isoFile       *baseIso
-	initramfsFile *baseInitramfs
-	baseURL       *url.URL
-	keys          map[string]string
-	images        map[string]*imageFile
-	mu            *sync.Mutex
-	log           logr.Logger
+	*baseImageSet
+	versions            map[string]*baseImageSet
+	baseURL             *url.URL
+	networkURLs         map[string]*url.URL
+	archURLs            map[string]*url.URL
+	checksumFormats     []checksumFormat
+	maxIgnitionSize     int64
+	archAliases         map[string]string
+	strictBaseImages    bool
+	checksumStaticNames bool
+	compressedISOs      bool
+	remoteIgnition      bool
+	keys                map[string]string
+	images              map[string]*imageFile
+	maintenance         bool
+	lockProbeTimeout    time.Duration
+	mu                  *sync.Mutex
+	log                 logr.Logger
 }
 
 var _ ImageHandler = &imageFileSystem{}
@@ -52,32 +101,263 @@ var _ http.FileSystem = &imageFileSystem{}
 
 type ImageHandler interface {
 	FileSystem() http.FileSystem
-	ServeImage(key string, ignitionContent []byte, initramfs, static bool) (string, error)
+	Handler() http.Handler
+	ServeImage(key, arch, version, network string, ignitionContent []byte, kargs []string, initramfs, static bool) (string, error)
 	RemoveImage(key string)
+	HasImagesForArchitecture(arch string) bool
+	MaintenanceHandler() http.Handler
+	InfoHandler() http.Handler
+	CheckBaseImages() error
+	CheckResponsive() error
 }
 
-func NewImageHandler(logger logr.Logger, isoFile, initramfsFile string, baseURL *url.URL) ImageHandler {
-	return &imageFileSystem{
-		log:           logger,
-		isoFile:       newBaseIso(isoFile),
-		initramfsFile: newBaseInitramfs(initramfsFile),
-		baseURL:       baseURL,
-		keys:          map[string]string{},
-		images:        map[string]*imageFile{},
-		mu:            &sync.Mutex{},
+// NewImageHandler returns an ImageHandler serving images built from the ISO and
+// initramfs files given in the environment. Any other base images alongside
+// them, named ironic-python-agent[-fcos].<arch>.(iso|initramfs), are made
+// available for their architecture, and subdirectories containing base images
+// make those available for the release version the subdirectory is named
+// after. Image URLs are based on baseURL, unless an image is requested for one
+// of the networks in networkURLs or for an architecture with its own publish
+// URL in the environment.
+func NewImageHandler(logger logr.Logger, baseURL *url.URL, networkURLs map[string]*url.URL, envInputs *env.EnvInputs) (ImageHandler, error) {
+	isoFile, initramfsFile := envInputs.DeployISO, envInputs.DeployInitrd
+	sharedDir := envInputs.ImageSharedDir
+	if sharedDir != "" {
+		if !filepath.IsAbs(isoFile) {
+			isoFile = filepath.Join(sharedDir, isoFile)
+		}
+		if !filepath.IsAbs(initramfsFile) {
+			initramfsFile = filepath.Join(sharedDir, initramfsFile)
+		}
+	}
+
+	checksumFormats, err := parseChecksumFormats(envInputs.ImageChecksumFormats)
+	if err != nil {
+		return nil, err
+	}
+
+	archAliases, err := parseArchAliases(envInputs.ImageArchAliases)
+	if err != nil {
+		return nil, err
+	}
+
+	archURLs, err := parseArchPublishURLs(envInputs.ImageArchPublishURLs)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &imageFileSystem{
+		log:                 logger,
+		baseImageSet:        newBaseImageSet(),
+		versions:            map[string]*baseImageSet{},
+		baseURL:             baseURL,
+		networkURLs:         networkURLs,
+		archURLs:            archURLs,
+		checksumFormats:     checksumFormats,
+		maxIgnitionSize:     envInputs.MaxIgnitionSize,
+		archAliases:         archAliases,
+		strictBaseImages:    envInputs.StrictBaseImages,
+		checksumStaticNames: envInputs.ChecksumStaticImageNames,
+		compressedISOs:      envInputs.ServeCompressedISOs,
+		remoteIgnition:      envInputs.RemoteIgnition,
+		keys:                map[string]string{},
+		images:              map[string]*imageFile{},
+		mu:                  &sync.Mutex{},
 	}
+	if err := f.indexBaseImages(sharedDir, isoFile, initramfsFile); err != nil {
+		return nil, err
+	}
+	if envInputs.PrecomputeChecksums {
+		f.precomputeChecksums(checksumConcurrency)
+	}
+	return f, nil
+}
+
+// indexBaseImages finds the available base images in sharedDir, or in the
+// directories of the default ISO and initramfs if it is empty. Files that
+// duplicate the base image of the same architecture and type are ignored with
+// a warning, or fail the indexing in strict mode.
+func (f *imageFileSystem) indexBaseImages(sharedDir, isoFile, initramfsFile string) error {
+	defaults := newBaseImageSet()
+	if _, _, fcos, _ := parseIronicImage(filepath.Base(isoFile)); fcos {
+		defaults.isoFiles[hostArchitecture] = newBaseFCOSIso(isoFile)
+	} else {
+		defaults.isoFiles[hostArchitecture] = newBaseIso(isoFile)
+	}
+	defaults.initramfsFiles[hostArchitecture] = newBaseInitramfs(initramfsFile)
+
+	versions := map[string]*baseImageSet{}
+	dirs := []string{sharedDir}
+	if sharedDir == "" {
+		dirs = []string{filepath.Dir(isoFile)}
+		if dir := filepath.Dir(initramfsFile); dir != dirs[0] {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		duplicates, err := loadBaseImages(f.log, dir, defaults, versions)
+		if err != nil {
+			return err
+		}
+		for _, duplicate := range duplicates {
+			if f.strictBaseImages {
+				return duplicate
+			}
+			f.log.Info("ignoring duplicate base image", "error", duplicate.Error())
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.baseImageSet = defaults
+	f.versions = versions
+	return nil
 }
 
 func (f *imageFileSystem) FileSystem() http.FileSystem {
 	return f
 }
 
-func (f *imageFileSystem) getBaseImage(initramfs bool) baseFile {
-	if initramfs {
-		return f.initramfsFile
+// unavailableRetryAfter is the number of seconds clients are asked to wait
+// before retrying a request for an image whose base image is missing.
+const unavailableRetryAfter = "5"
+
+// imageContentType is the Content-Type of served images, regardless of the
+// extension or content.
+const imageContentType = "application/octet-stream"
+
+// Handler returns an http.Handler serving the images. Images are served with an
+// ETag, so that a client fetching an unchanged image again with If-None-Match
+// gets 304 Not Modified. Requests for an image whose base image has gone
+// missing fail with 503 Service Unavailable, until it returns. For debugging,
+// the unmodified base image of an image is served if the passthrough query
+// parameter is true. Initramfs images are compressed with gzip on the fly for
+// clients that accept it, unless a range is requested; ISOs are always served
+// as they are, since BMCs expect them raw. If enabled, a gzip-compressed copy
+// of each ISO is also available with a .gz suffix, for mirroring. Images that
+// embed only a reference to their ignition config have the full config served
+// at ignition/<name>.
+func (f *imageFileSystem) Handler() http.Handler {
+	fileServer := http.FileServer(f)
+	return instrumentImageHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dir, name := path.Split(r.URL.Path); path.Base(dir) == remoteIgnitionPath {
+			f.serveIgnition(w, r, name)
+			return
+		}
+		name, compressed := path.Base(r.URL.Path), false
+		if f.compressedISOs && strings.HasSuffix(name, compressedISOSuffix) {
+			if im := f.imageFileByName(strings.TrimSuffix(name, compressedISOSuffix)); im != nil && !im.initramfs {
+				name, compressed = im.name, true
+			}
+		}
+		if im := f.imageFileByName(name); im != nil {
+			if err := f.baseImageAvailable(im); err != nil {
+				f.log.Error(err, "base image not available", "name", im.name)
+				w.Header().Set("Retry-After", unavailableRetryAfter)
+				http.Error(w, "base image not available", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", imageContentType)
+			if compressed {
+				w.Header().Set("Content-Type", compressedContentType)
+			} else if r.URL.Query().Get("passthrough") == "true" {
+				f.servePassthrough(w, r, im)
+				return
+			}
+			if etag, err := f.imageETag(im); err != nil {
+				f.log.Error(err, "failed to compute image ETag", "name", im.name)
+			} else {
+				w.Header().Set("ETag", etag)
+			}
+			if compressed {
+				f.serveGzip(w, r, im, false)
+				return
+			}
+			if im.initramfs {
+				w.Header().Add("Vary", "Accept-Encoding")
+				if acceptsGzip(r) && r.Header.Get("Range") == "" &&
+					(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+					f.serveGzip(w, r, im, true)
+					return
+				}
+			}
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+}
+
+// servePassthrough serves the base image of an image as it is on disk,
+// without the ignition.
+func (f *imageFileSystem) servePassthrough(w http.ResponseWriter, r *http.Request, im *imageFile) {
+	baseImage := f.getBaseImage(im.arch, im.version, im.initramfs)
+	if baseImage == nil {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(baseImage.Path())
+	if err != nil {
+		f.log.Error(err, "failed to open base image", "name", im.name)
+		http.Error(w, "base image not available", http.StatusServiceUnavailable)
+		return
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		f.log.Error(err, "failed to open base image", "name", im.name)
+		http.Error(w, "base image not available", http.StatusServiceUnavailable)
+		return
+	}
+	f.log.Info("serving base image without ignition", "name", im.name, "path", baseImage.Path())
+	http.ServeContent(w, r, im.name, fi.ModTime(), file)
+}
+
+// getBaseImage returns the base image to use for the given architecture and
+// release version. If no version is requested, the default images are
+// preferred over those of the latest version. An image for the requested
+// architecture is always preferred over one for the architecture it is an
+// alias of, which is preferred over a host image. Host images are only used
+// for the architecture the controller is running on, or if none is given.
+func (f *imageFileSystem) getBaseImage(arch, version string, initramfs bool) baseFile {
+	arch = normalizeArch(arch)
+	var sets []*baseImageSet
+	if version != "" {
+		if set, exists := f.versions[version]; exists {
+			sets = append(sets, set)
+		}
 	} else {
-		return f.isoFile
+		sets = append(sets, f.baseImageSet)
+		for _, v := range sortedVersions(f.versions) {
+			sets = append(sets, f.versions[v])
+		}
+	}
+
+	archs := []string{arch}
+	if alias, exists := f.archAliases[arch]; exists {
+		archs = append(archs, alias)
+	}
+	if slices.Contains(archs, "") || slices.Contains(archs, hostArchitectureName()) {
+		archs = append(archs, hostArchitecture)
+	}
+	for _, a := range archs {
+		for _, set := range sets {
+			if file := set.getBaseImage(a, initramfs); file != nil {
+				return file
+			}
+		}
+	}
+	return nil
+}
+
+// baseImageAvailable returns an error if the base image of an image is
+// missing.
+func (f *imageFileSystem) baseImageAvailable(im *imageFile) error {
+	baseImage := f.getBaseImage(im.arch, im.version, im.initramfs)
+	if baseImage == nil {
+		return fmt.Errorf("no base image for architecture %q version %q", im.arch, im.version)
 	}
+	return baseImage.Available()
 }
 
 func (f *imageFileSystem) getNameForKey(key string) (name string, err error) {
@@ -91,38 +371,128 @@ func (f *imageFileSystem) getNameForKey(key string) (name string, err error) {
 	return
 }
 
-func (f *imageFileSystem) ServeImage(key string, ignitionContent []byte, initramfs, static bool) (string, error) {
-	size, err := f.getBaseImage(initramfs).Size()
+// imageFormat returns the name of the format of an image, for logging.
+func imageFormat(initramfs bool) string {
+	if initramfs {
+		return "initramfs"
+	}
+	return "iso"
+}
+
+// ServeImage makes an image available and returns its URL. The URL is based
+// on the publish URL of the given network. If no network is given, it is
+// based on the publish URL of the architecture, if it has one, or otherwise on
+// the default publish URL. The kernel arguments are added to the boot entries
+// of an ISO, or to the .kargs file of an initramfs.
+func (f *imageFileSystem) ServeImage(key, arch, version, network string, ignitionContent []byte, kargs []string, initramfs, static bool) (string, error) {
+	arch = normalizeArch(arch)
+	log := f.log.WithValues("key", key, "arch", arch, "version", version,
+		"format", imageFormat(initramfs), "static", static)
+
+	// Only a small reference is embedded when the ignition is served remotely.
+	if f.maxIgnitionSize > 0 && !f.remoteIgnition && int64(len(ignitionContent)) > f.maxIgnitionSize {
+		log.Info("ignition config too large", "size", len(ignitionContent))
+		return "", IgnitionTooLargeError{size: len(ignitionContent), limit: f.maxIgnitionSize}
+	}
+
+	baseURL := f.baseURL
+	if network != "" {
+		var exists bool
+		if baseURL, exists = f.networkURLs[network]; !exists {
+			return "", UnknownNetworkError{network: network}
+		}
+		log = log.WithValues("network", network)
+	} else if archURL, exists := f.archURLs[arch]; exists {
+		baseURL = archURL
+	}
+
+	baseImage := f.getBaseImage(arch, version, initramfs)
+	if baseImage == nil {
+		log.Info("no base image available")
+		return "", InvalidBaseImageError{
+			cause: fmt.Errorf("no base image for architecture %q version %q", arch, version),
+		}
+	}
+	if iso, ok := baseImage.(*baseIso); ok && iso.fcos && len(kargs) > 0 {
+		log.Info("kernel arguments not supported by base image", "path", iso.Path())
+		return "", InvalidBaseImageError{cause: errFCOSKargs}
+	}
+	// The size is cached, so check that the file is still there.
+	if err := baseImage.Available(); err != nil {
+		log.Info("base image not available", "error", err.Error())
+		return "", InvalidBaseImageError{cause: err}
+	}
+	size, err := baseImage.Size()
 	if err != nil {
+		log.Info("base image not available", "error", err.Error())
 		return "", InvalidBaseImageError{cause: err}
 	}
 
+	// Computing the checksum of the base image takes a while the first time,
+	// so do it before taking the lock.
+	digest := ""
+	if static && f.checksumStaticNames {
+		baseChecksum, err := baseImage.Checksum()
+		if err != nil {
+			log.Info("base image not available", "error", err.Error())
+			return "", InvalidBaseImageError{cause: err}
+		}
+		digest = imageDigest(baseChecksum, ignitionContent, kargs)
+	}
+
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	name := key
-	if !static {
+	if digest != "" {
+		ext := path.Ext(key)
+		name = fmt.Sprintf("%s-%s%s", strings.TrimSuffix(key, ext), digest, ext)
+	} else if !static {
 		name, err = f.getNameForKey(key)
 		if err != nil {
 			return "", err
 		}
 	}
-	p, err := url.Parse(fmt.Sprintf("/%s", name))
-	if err != nil {
-		return "", err
+	var pointer []byte
+	if f.remoteIgnition {
+		pointer, err = pointerIgnition(remoteIgnitionURL(baseURL, name), ignitionContent)
+		if err != nil {
+			return "", err
+		}
 	}
-
-	if _, exists := f.images[key]; !exists {
+	// Replace an existing image if it was built from different inputs, so
+	// that the latest ignition is always served at the same URL.
+	if img, exists := f.images[key]; !exists || img.arch != arch || img.version != version ||
+		!bytes.Equal(img.ignitionContent, ignitionContent) || !bytes.Equal(img.pointerIgnition, pointer) ||
+		!slices.Equal(img.kargs, kargs) {
+		if f.maintenance {
+			return "", MaintenanceError{}
+		}
+		if exists {
+			log.Info("replacing image with changed content")
+			delete(f.keys, img.name)
+		}
 		f.keys[name] = key
 		f.images[key] = &imageFile{
 			name:            name,
 			size:            size,
 			ignitionContent: ignitionContent,
+			pointerIgnition: pointer,
+			kargs:           kargs,
+			arch:            arch,
+			version:         version,
 			initramfs:       initramfs,
 		}
+		imageCacheMisses.Inc()
+	} else {
+		imageCacheHits.Inc()
 	}
 
-	return f.baseURL.ResolveReference(p).String(), nil
+	// Any path in the base URL is kept as a prefix, for servers published
+	// behind a proxy.
+	imageURL := baseURL.JoinPath(name).String()
+	log.Info("serving image", "url", imageURL)
+	return imageURL, nil
 }
 
 func (f *imageFileSystem) imageFileByName(name string) *imageFile {
@@ -144,3 +514,160 @@ func (f *imageFileSystem) RemoveImage(key string) {
 		delete(f.images, key)
 	}
 }
+
+// CheckBaseImages returns an error unless the default base images, given in
+// the environment, can be read.
+func (f *imageFileSystem) CheckBaseImages() error {
+	f.mu.Lock()
+	defaults := f.baseImageSet
+	f.mu.Unlock()
+
+	files := []*baseFileData{}
+	if iso, exists := defaults.isoFiles[hostArchitecture]; exists {
+		files = append(files, &iso.baseFileData)
+	}
+	if initramfs, exists := defaults.initramfsFiles[hostArchitecture]; exists {
+		files = append(files, &initramfs.baseFileData)
+	}
+	if len(files) == 0 {
+		return errors.New("no base images found")
+	}
+	for _, file := range files {
+		if err := file.checkReadable(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultLockProbeTimeout is how long CheckResponsive waits for the lock on
+// the images. It is only ever held briefly, so this is long enough to tell a
+// stuck holder from a busy one, yet short enough for a liveness probe.
+const defaultLockProbeTimeout = 500 * time.Millisecond
+
+// lockProbeInterval is how often CheckResponsive tries to take the lock.
+const lockProbeInterval = 10 * time.Millisecond
+
+// CheckResponsive returns an error if the lock on the images cannot be taken
+// in time, which means that serving images is deadlocked. It polls rather than
+// blocking, so that repeated checks never pile up behind a stuck holder.
+func (f *imageFileSystem) CheckResponsive() error {
+	timeout := f.lockProbeTimeout
+	if timeout == 0 {
+		timeout = defaultLockProbeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for !f.mu.TryLock() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("images have been locked for over %s", timeout)
+		}
+		time.Sleep(lockProbeInterval)
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+// HasImagesForArchitecture returns whether any base image is available for
+// the given architecture, checking that its file still exists. Host images
+// count only for the architecture the controller itself is running on. An
+// alias is supported if the architecture it is an alias of is. A host that
+// reports no architecture, e.g. because it has not been inspected yet, is
+// given the images of the controller's architecture. Base images are only
+// indexed by NewImageHandler, so files added for another architecture or
+// version afterwards are not found until the controller is restarted.
+func (f *imageFileSystem) HasImagesForArchitecture(arch string) bool {
+	arch = normalizeArch(arch)
+	if arch == "" {
+		arch = hostArchitectureName()
+	}
+	if alias, exists := f.archAliases[arch]; exists && f.hasImagesForArchitecture(alias) {
+		return true
+	}
+	return f.hasImagesForArchitecture(arch)
+}
+
+func (f *imageFileSystem) hasImagesForArchitecture(arch string) bool {
+	sets := []*baseImageSet{f.baseImageSet}
+	for _, set := range f.versions {
+		sets = append(sets, set)
+	}
+
+	for _, set := range sets {
+		if set.hasArchitecture(arch) {
+			return true
+		}
+		if arch == hostArchitectureName() && set.hasArchitecture(hostArchitecture) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePublishURL parses the address clients access the images server from,
+// which must be an absolute http or https URL with a host. It may include a
+// path, which is used as a prefix of the image URLs.
+func ParsePublishURL(address string) (*url.URL, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("publish address %q is not an http or https URL", address)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("publish address %q has no host", address)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("publish address %q must not have a query or fragment", address)
+	}
+	return u, nil
+}
+
+// parseArchPublishURLs parses a comma delimited list of arch=address pairs,
+// giving the publish URL of the images for hosts of each architecture.
+func parseArchPublishURLs(urls string) (map[string]*url.URL, error) {
+	result := map[string]*url.URL{}
+	for _, entry := range strings.Split(urls, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		arch, address, found := strings.Cut(entry, "=")
+		if !found || arch == "" {
+			return nil, fmt.Errorf("invalid architecture publish URL %q, expected arch=address", entry)
+		}
+		u, err := ParsePublishURL(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid publish URL for architecture %s: %w", arch, err)
+		}
+		result[normalizeArch(arch)] = u
+	}
+	return result, nil
+}
+
+// ResolveURLHost returns a copy of u with its hostname replaced by an IP
+// address it resolves to, for hosts that cannot resolve the name themselves.
+func ResolveURLHost(u *url.URL) (*url.URL, error) {
+	hostname := u.Hostname()
+	if net.ParseIP(hostname) != nil {
+		return u, nil
+	}
+
+	addrs, err := lookupHost(hostname)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", hostname)
+	}
+
+	resolved := *u
+	if port := u.Port(); port != "" {
+		resolved.Host = net.JoinHostPort(addrs[0], port)
+	} else if strings.Contains(addrs[0], ":") {
+		resolved.Host = "[" + addrs[0] + "]"
+	} else {
+		resolved.Host = addrs[0]
+	}
+	return &resolved, nil
+}
@@ -14,15 +14,34 @@ limitations under the License.
 package imagehandler
 
 import (
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	ignition_config_types_32 "github.com/coreos/ignition/v2/config/v3_2/types"
+	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/openshift/image-customization-controller/pkg/env"
 )
 
 type closer struct {
@@ -37,32 +56,71 @@ func nopCloser(stream io.ReadSeeker) io.ReadSeekCloser {
 	return closer{stream}
 }
 
+// newTestBaseImageDir returns a temporary directory holding the host base
+// images, ironic-python-agent.iso and ironic-python-agent.initramfs, along with
+// any other base images named.
+func newTestBaseImageDir(t *testing.T, names ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range append([]string{"ironic-python-agent.iso", "ironic-python-agent.initramfs"}, names...) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// newTestImageFileSystem returns an imageFileSystem serving the given images,
+// built from host base images in a temporary directory.
+func newTestImageFileSystem(t *testing.T, images ...*imageFile) *imageFileSystem {
+	t.Helper()
+	dir := t.TempDir()
+	iso := filepath.Join(dir, "ironic-python-agent.iso")
+	initramfs := filepath.Join(dir, "ironic-python-agent.initramfs")
+	for _, name := range []string{iso, initramfs} {
+		if err := os.WriteFile(name, []byte(filepath.Ext(name)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	baseURL, _ := url.Parse("http://localhost:8080")
+	f := &imageFileSystem{
+		log: zap.New(zap.UseDevMode(true)),
+		baseImageSet: &baseImageSet{
+			isoFiles: map[string]*baseIso{
+				hostArchitecture: {baseFileData: baseFileData{filename: iso, size: 12345}},
+			},
+			initramfsFiles: map[string]*baseInitramfs{
+				hostArchitecture: {baseFileData: baseFileData{filename: initramfs, size: 12345}},
+			},
+		},
+		versions: map[string]*baseImageSet{},
+		baseURL:  baseURL,
+		keys:     map[string]string{},
+		images:   map[string]*imageFile{},
+		mu:       &sync.Mutex{},
+	}
+	for _, im := range images {
+		key := "key-" + im.name
+		f.keys[im.name] = key
+		f.images[key] = im
+	}
+	return f
+}
+
 func TestImageHandler(t *testing.T) {
 	req, err := http.NewRequest("GET", "/host-xyz-45-uuid", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	baseURL, _ := url.Parse("http://localhost:8080")
-
 	rr := httptest.NewRecorder()
-	imageServer := &imageFileSystem{
-		log:     zap.New(zap.UseDevMode(true)),
-		isoFile: &baseIso{baseFileData{filename: "dummyfile.iso", size: 12345}},
-		baseURL: baseURL,
-		keys: map[string]string{
-			"host-xyz-45-uuid": "host-xyz-45.iso",
-		},
-		images: map[string]*imageFile{
-			"host-xyz-45.iso": {
-				name:            "host-xyz-45-uuid",
-				size:            12345,
-				ignitionContent: []byte("asietonarst"),
-				imageReader:     nopCloser(strings.NewReader("aiosetnarsetin")),
-			},
-		},
-		mu: &sync.Mutex{},
-	}
+	imageServer := newTestImageFileSystem(t, &imageFile{
+		name:            "host-xyz-45-uuid",
+		size:            12345,
+		ignitionContent: []byte("asietonarst"),
+		imageReader:     nopCloser(strings.NewReader("aiosetnarsetin")),
+	})
 
 	handler := http.FileServer(imageServer.FileSystem())
 	handler.ServeHTTP(rr, req)
@@ -81,25 +139,56 @@ func TestImageHandler(t *testing.T) {
 	}
 }
 
+func TestImageHandlerHeaders(t *testing.T) {
+	content := "aiosetnarsetin"
+	imageServer := newTestImageFileSystem(t, &imageFile{
+		name:            "host-xyz-45.iso",
+		size:            int64(len(content)),
+		ignitionContent: []byte("asietonarst"),
+		imageReader:     nopCloser(strings.NewReader(content)),
+	})
+
+	rr := httptest.NewRecorder()
+	imageServer.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/host-xyz-45.iso", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if cl := rr.Header().Get("Content-Length"); cl != fmt.Sprint(len(content)) {
+		t.Errorf("unexpected Content-Length %q, expected %d", cl, len(content))
+	}
+	if te := rr.Header().Get("Transfer-Encoding"); te != "" {
+		t.Errorf("unexpected Transfer-Encoding %q", te)
+	}
+}
+
 func TestNewImageHandler(t *testing.T) {
 	baseUrl, err := url.Parse("http://base.test:1234")
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
-	handler := NewImageHandler(zap.New(zap.UseDevMode(true)),
-		"dummyfile.iso",
-		"dummyfile.initramfs",
-		baseUrl)
+	dir := newTestBaseImageDir(t)
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: filepath.Join(dir, "ironic-python-agent.initramfs"),
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
 
 	ifs := handler.(*imageFileSystem)
-	ifs.isoFile.size = 12345
-	ifs.initramfsFile.size = 12345
+	ifs.isoFiles[hostArchitecture].size = 12345
+	ifs.initramfsFiles[hostArchitecture].size = 12345
 
-	url1, err := handler.ServeImage("test-key-1", []byte{}, false, false)
+	url1, err := handler.ServeImage("test-key-1", "", "", "", []byte{}, nil, false, false)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
-	url2, err := handler.ServeImage("test-key-2", []byte{}, true, false)
+	url2, err := handler.ServeImage("test-key-2", "", "", "", []byte{}, nil, true, false)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
@@ -109,7 +198,7 @@ func TestNewImageHandler(t *testing.T) {
 		t.Errorf("can't look up image file \"%s\"", name2)
 	}
 
-	url1again, err := handler.ServeImage("test-key-1", []byte{}, false, false)
+	url1again, err := handler.ServeImage("test-key-1", "", "", "", []byte{}, nil, false, false)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
@@ -119,7 +208,7 @@ func TestNewImageHandler(t *testing.T) {
 	}
 
 	handler.RemoveImage("test-key-1")
-	url1yetagain, err := handler.ServeImage("test-key-1", []byte{}, false, false)
+	url1yetagain, err := handler.ServeImage("test-key-1", "", "", "", []byte{}, nil, false, false)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
@@ -128,29 +217,101 @@ func TestNewImageHandler(t *testing.T) {
 	}
 }
 
+func TestServeImageNetworks(t *testing.T) {
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	managementUrl, _ := url.Parse("http://10.0.0.5:8084")
+	dir := newTestBaseImageDir(t)
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, map[string]*url.URL{"management": managementUrl},
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: filepath.Join(dir, "ironic-python-agent.initramfs"),
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	handler.(*imageFileSystem).isoFiles[hostArchitecture].size = 12345
+
+	defaultURL, err := handler.ServeImage("test-key", "", "", "", []byte{}, nil, false, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	managementURL, err := handler.ServeImage("test-key", "", "", "management", []byte{}, nil, false, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !strings.HasPrefix(defaultURL, "http://base.test:1234/") {
+		t.Errorf("unexpected default URL %s", defaultURL)
+	}
+	if !strings.HasPrefix(managementURL, "http://10.0.0.5:8084/") {
+		t.Errorf("unexpected management URL %s", managementURL)
+	}
+	if path.Base(defaultURL) != path.Base(managementURL) {
+		t.Errorf("URLs for the same key refer to different images: %s %s", defaultURL, managementURL)
+	}
+
+	if _, err := handler.ServeImage("test-key", "", "", "storage", []byte{}, nil, false, false); !errors.As(err, &UnknownNetworkError{}) {
+		t.Errorf("expected UnknownNetworkError, got %v", err)
+	}
+}
+
+func TestServeImageIgnitionTooLarge(t *testing.T) {
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	dir := newTestBaseImageDir(t)
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:       filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd:    filepath.Join(dir, "ironic-python-agent.initramfs"),
+			MaxIgnitionSize: 16,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	handler.(*imageFileSystem).isoFiles[hostArchitecture].size = 12345
+
+	if _, err := handler.ServeImage("test-key", "", "", "", make([]byte, 16), nil, false, false); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	_, err = handler.ServeImage("test-key", "", "", "", make([]byte, 17), nil, false, false)
+	if !errors.As(err, &IgnitionTooLargeError{}) {
+		t.Fatalf("expected IgnitionTooLargeError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "17 bytes") {
+		t.Errorf("error does not report the size: %v", err)
+	}
+}
+
 func TestNewImageHandlerStatic(t *testing.T) {
 	baseUrl, err := url.Parse("http://base.test:1234")
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
-	handler := NewImageHandler(zap.New(zap.UseDevMode(true)),
-		"dummyfile.iso",
-		"dummyfile.initramfs",
-		baseUrl)
+	dir := newTestBaseImageDir(t)
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: filepath.Join(dir, "ironic-python-agent.initramfs"),
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
 
 	ifs := handler.(*imageFileSystem)
-	ifs.isoFile.size = 12345
-	ifs.initramfsFile.size = 12345
+	ifs.isoFiles[hostArchitecture].size = 12345
+	ifs.initramfsFiles[hostArchitecture].size = 12345
 
-	url1, err := handler.ServeImage("test-name-1.iso", []byte{}, false, true)
+	url1, err := handler.ServeImage("test-name-1.iso", "", "", "", []byte{}, nil, false, true)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
-	url2, err := handler.ServeImage("test-name-2.initramfs", []byte{}, true, true)
+	url2, err := handler.ServeImage("test-name-2.initramfs", "", "", "", []byte{}, nil, true, true)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
-	url1again, err := handler.ServeImage("test-name-1.iso", []byte{}, false, true)
+	url1again, err := handler.ServeImage("test-name-1.iso", "", "", "", []byte{}, nil, false, true)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
@@ -167,3 +328,1600 @@ func TestNewImageHandlerStatic(t *testing.T) {
 		t.Errorf("inconsistent URLs for same key: %s %s", url1, url1again)
 	}
 }
+
+func TestNewImageHandlerStaticChecksumNames(t *testing.T) {
+	dir := t.TempDir()
+	isoFile := filepath.Join(dir, "ironic-python-agent.iso")
+	if err := os.WriteFile(isoFile, []byte("base image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:                isoFile,
+			DeployInitrd:             filepath.Join(dir, "ironic-python-agent.initramfs"),
+			ChecksumStaticImageNames: true,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	baseHash := sha256.Sum256([]byte("base image"))
+	digest := imageDigest(hex.EncodeToString(baseHash[:]), []byte("ignition"), nil)
+	url1, err := handler.ServeImage("worker-0.iso", "", "", "", []byte("ignition"), nil, false, true)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if want := "http://base.test:1234/worker-0-" + digest + ".iso"; url1 != want {
+		t.Errorf("unexpected url %s (should be %s)", url1, want)
+	}
+
+	url2, err := handler.ServeImage("worker-0.iso", "", "", "", []byte("changed"), nil, false, true)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if url2 == url1 {
+		t.Error("name not changed with the content")
+	}
+	ifs := handler.(*imageFileSystem)
+	if ifs.imageFileByName(path.Base(url1)) != nil {
+		t.Error("old name still served")
+	}
+	if ifs.imageFileByName(path.Base(url2)) == nil {
+		t.Error("new name not served")
+	}
+}
+
+func TestNewImageHandlerSharedDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"ironic-python-agent.iso",
+		"ironic-python-agent.initramfs",
+		"ironic-python-agent.aarch64.iso",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:      "ironic-python-agent.iso",
+			DeployInitrd:   "ironic-python-agent.initramfs",
+			ImageSharedDir: dir,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ifs := handler.(*imageFileSystem)
+
+	for arch, want := range map[string]string{
+		hostArchitecture: "ironic-python-agent.iso",
+		"aarch64":        "ironic-python-agent.aarch64.iso",
+	} {
+		got := ifs.getBaseImage(arch, "", false)
+		if got == nil {
+			t.Fatalf("no base image for %s", arch)
+		}
+		if got.Path() != filepath.Join(dir, want) {
+			t.Errorf("got base image %s for %s, want %s", got.Path(), arch, want)
+		}
+	}
+	if got := ifs.getBaseImage(hostArchitecture, "", true); got == nil || got.Path() != filepath.Join(dir, "ironic-python-agent.initramfs") {
+		t.Errorf("unexpected base initramfs %v", got)
+	}
+}
+
+func TestBaseImageVersions(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"ironic-python-agent.iso",
+		"ironic-python-agent.initramfs",
+		"4.9/ironic-python-agent.x86_64.iso",
+		"4.13/ironic-python-agent.x86_64.iso",
+		"4.14/ironic-python-agent.x86_64.iso",
+		"4.14/ironic-python-agent.x86_64.initramfs",
+		"lost+found/unrelated",
+		"unreadable/unrelated",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Subdirectories that are unrelated or cannot be read must not prevent
+	// the other base images from being served.
+	unreadable := filepath.Join(dir, "unreadable")
+	if err := os.Chmod(unreadable, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chmod(unreadable, 0755) })
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: filepath.Join(dir, "ironic-python-agent.initramfs"),
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ifs := handler.(*imageFileSystem)
+	if _, exists := ifs.versions["lost+found"]; exists {
+		t.Errorf("unexpected version for a directory without base images")
+	}
+
+	tests := []struct {
+		name      string
+		arch      string
+		version   string
+		initramfs bool
+		want      string
+	}{
+		{name: "explicit version", arch: "x86_64", version: "4.13", want: "4.13/ironic-python-agent.x86_64.iso"},
+		{name: "other version", arch: "x86_64", version: "4.9", want: "4.9/ironic-python-agent.x86_64.iso"},
+		{name: "latest version", arch: "x86_64", want: "4.14/ironic-python-agent.x86_64.iso"},
+		{name: "latest initramfs", arch: "x86_64", initramfs: true, want: "4.14/ironic-python-agent.x86_64.initramfs"},
+		{name: "host fallback", arch: "", want: "ironic-python-agent.iso"},
+		{name: "no host fallback for other architectures", arch: "ppc64le"},
+		{name: "version without initramfs", arch: "x86_64", version: "4.13", initramfs: true},
+		{name: "missing version", arch: "x86_64", version: "4.15"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ifs.getBaseImage(tt.arch, tt.version, tt.initramfs)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("unexpected base image %v", got)
+				}
+				return
+			}
+			var filename string
+			switch f := got.(type) {
+			case *baseIso:
+				filename = f.filename
+			case *baseInitramfs:
+				filename = f.filename
+			default:
+				t.Fatalf("unexpected base image %v", got)
+			}
+			if filename != filepath.Join(dir, tt.want) {
+				t.Errorf("got base image %s, want %s", filename, tt.want)
+			}
+		})
+	}
+
+	_, err = handler.ServeImage("test-key", "x86_64", "4.15", "", []byte{}, nil, false, false)
+	if !errors.As(err, &InvalidBaseImageError{}) {
+		t.Errorf("expected InvalidBaseImageError, got %v", err)
+	}
+}
+
+func TestDuplicateBaseImages(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"ironic-python-agent.iso",
+		"ironic-python-agent.initramfs",
+		"ironic-python-agent-fcos.iso",
+		"ironic-python-agent.x86_64.iso",
+		"ironic-python-agent-fcos.x86_64.iso",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputs := &env.EnvInputs{
+		DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+		DeployInitrd: filepath.Join(dir, "ironic-python-agent.initramfs"),
+	}
+	baseUrl, _ := url.Parse("http://base.test:1234")
+
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)), baseUrl, nil, inputs)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ifs := handler.(*imageFileSystem)
+	if got := ifs.isoFiles[hostArchitecture].filename; got != inputs.DeployISO {
+		t.Errorf("unexpected host base image %s", got)
+	}
+	if got := ifs.isoFiles["x86_64"].filename; got != filepath.Join(dir, "ironic-python-agent-fcos.x86_64.iso") {
+		t.Errorf("unexpected x86_64 base image %s", got)
+	}
+
+	inputs.StrictBaseImages = true
+	_, err = NewImageHandler(zap.New(zap.UseDevMode(true)), baseUrl, nil, inputs)
+	duplicate := duplicateBaseImageError{}
+	if !errors.As(err, &duplicate) {
+		t.Fatalf("expected duplicateBaseImageError, got %v", err)
+	}
+	if duplicate.ignored != filepath.Join(dir, "ironic-python-agent-fcos.iso") || duplicate.used != inputs.DeployISO {
+		t.Errorf("unexpected duplicate %v", duplicate)
+	}
+}
+
+func TestHasImagesForArchitecture(t *testing.T) {
+	otherArch := "aarch64"
+	if hostArchitectureName() == otherArch {
+		otherArch = "x86_64"
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"ironic-python-agent.iso", "ironic-python-agent.initramfs", "ironic-python-agent." + otherArch + ".iso"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hostOnly := &imageFileSystem{
+		baseImageSet: &baseImageSet{
+			isoFiles:       map[string]*baseIso{hostArchitecture: newBaseIso(filepath.Join(dir, "ironic-python-agent.iso"))},
+			initramfsFiles: map[string]*baseInitramfs{hostArchitecture: newBaseInitramfs(filepath.Join(dir, "ironic-python-agent.initramfs"))},
+		},
+	}
+	if !hostOnly.HasImagesForArchitecture(hostArchitectureName()) {
+		t.Errorf("expected host architecture %s to be supported", hostArchitectureName())
+	}
+	if hostOnly.HasImagesForArchitecture(otherArch) {
+		t.Errorf("expected architecture %s not to be supported", otherArch)
+	}
+	if !hostOnly.HasImagesForArchitecture("") {
+		t.Error("expected an empty architecture to be supported")
+	}
+
+	versioned := &imageFileSystem{
+		baseImageSet: newBaseImageSet(),
+		versions: map[string]*baseImageSet{
+			"4.14": {
+				isoFiles:       map[string]*baseIso{otherArch: newBaseIso(filepath.Join(dir, "ironic-python-agent."+otherArch+".iso"))},
+				initramfsFiles: map[string]*baseInitramfs{},
+			},
+		},
+	}
+	if !versioned.HasImagesForArchitecture(otherArch) {
+		t.Errorf("expected architecture %s to be supported", otherArch)
+	}
+	if versioned.HasImagesForArchitecture(hostArchitectureName()) {
+		t.Errorf("expected host architecture %s not to be supported", hostArchitectureName())
+	}
+	if versioned.HasImagesForArchitecture("") {
+		t.Error("expected an empty architecture not to be supported")
+	}
+}
+
+func TestArchAliases(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"ironic-python-agent.iso",
+		"ironic-python-agent.initramfs",
+		"ironic-python-agent.x86_64.iso",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:        filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd:     filepath.Join(dir, "ironic-python-agent.initramfs"),
+			ImageArchAliases: "foo=x86_64",
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ifs := handler.(*imageFileSystem)
+
+	if !handler.HasImagesForArchitecture("foo") {
+		t.Error("expected alias foo to be supported")
+	}
+	if handler.HasImagesForArchitecture("bar") {
+		t.Error("expected architecture bar not to be supported")
+	}
+
+	got, ok := ifs.getBaseImage("foo", "", false).(*baseIso)
+	if !ok || got.filename != filepath.Join(dir, "ironic-python-agent.x86_64.iso") {
+		t.Errorf("alias foo did not resolve to the x86_64 base image: %v", got)
+	}
+
+	if _, err := handler.ServeImage("test-key", "foo", "", "", []byte{}, nil, false, false); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestParseArchAliases(t *testing.T) {
+	aliases, err := parseArchAliases(" foo=x86_64, bar=aarch64 ,")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(aliases) != 2 || aliases["foo"] != "x86_64" || aliases["bar"] != "aarch64" {
+		t.Errorf("unexpected aliases %v", aliases)
+	}
+
+	for _, invalid := range []string{"foo", "=x86_64", "foo=", "x86_64=x86_64"} {
+		if _, err := parseArchAliases(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestParseIronicImage(t *testing.T) {
+	tests := []struct {
+		filename string
+		arch     string
+		fileType string
+		fcos     bool
+		ok       bool
+	}{
+		{filename: "ironic-python-agent.iso", arch: hostArchitecture, fileType: "iso", ok: true},
+		{filename: "ironic-python-agent.x86_64.initramfs", arch: "x86_64", fileType: "initramfs", ok: true},
+		{filename: "ironic-python-agent-fcos.iso", arch: hostArchitecture, fileType: "iso", fcos: true, ok: true},
+		{filename: "ironic-python-agent-fcos.aarch64.iso", arch: "aarch64", fileType: "iso", fcos: true, ok: true},
+		{filename: "ironic-python-agent.aarch64.kernel"},
+		{filename: "fedora-coreos-live.x86_64.iso"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			arch, fileType, fcos, ok := parseIronicImage(tt.filename)
+			if arch != tt.arch || fileType != tt.fileType || fcos != tt.fcos || ok != tt.ok {
+				t.Errorf("parseIronicImage() = %q, %q, %v, %v", arch, fileType, fcos, ok)
+			}
+		})
+	}
+}
+
+func TestFCOSBaseImages(t *testing.T) {
+	set := newBaseImageSet()
+	set.addFile("/images", "ironic-python-agent.x86_64.iso")
+	set.addFile("/images", "ironic-python-agent-fcos.aarch64.iso")
+	set.addFile("/images", "ironic-python-agent-fcos.aarch64.initramfs")
+
+	if set.isoFiles["x86_64"].fcos {
+		t.Error("RHCOS image indexed as FCOS")
+	}
+	if !set.isoFiles["aarch64"].fcos {
+		t.Error("FCOS image not indexed as FCOS")
+	}
+	if _, exists := set.initramfsFiles["aarch64"]; !exists {
+		t.Error("FCOS initramfs not indexed")
+	}
+}
+
+func TestParsePublishURL(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: "http://images.example.com:8084"},
+		{input: "https://proxy.example.com/images/"},
+		{input: "images.example.com:8084", wantErr: true},
+		{input: "/images", wantErr: true},
+		{input: "ftp://images.example.com", wantErr: true},
+		{input: "http:///images", wantErr: true},
+		{input: "http://images.example.com/?x=1", wantErr: true},
+		{input: "http://[::1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := ParsePublishURL(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParsePublishURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServeImagePathPrefix(t *testing.T) {
+	for _, address := range []string{"https://proxy.example.com/images", "https://proxy.example.com/images/"} {
+		t.Run(address, func(t *testing.T) {
+			baseUrl, err := ParsePublishURL(address)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			dir := newTestBaseImageDir(t)
+			handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+				baseUrl, nil,
+				&env.EnvInputs{
+					DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+					DeployInitrd: filepath.Join(dir, "ironic-python-agent.initramfs"),
+				})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			handler.(*imageFileSystem).isoFiles[hostArchitecture].size = 12345
+
+			imageURL, err := handler.ServeImage("worker-0.iso", "", "", "", []byte{}, nil, false, true)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if want := "https://proxy.example.com/images/worker-0.iso"; imageURL != want {
+				t.Errorf("unexpected url %s (should be %s)", imageURL, want)
+			}
+		})
+	}
+}
+
+func TestServeImageArchPublishURLs(t *testing.T) {
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	dir := newTestBaseImageDir(t, "ironic-python-agent.aarch64.iso", "ironic-python-agent.ppc64le.iso")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, map[string]*url.URL{"mgmt": {Scheme: "http", Host: "mgmt.test:1234"}},
+		&env.EnvInputs{
+			DeployISO:            filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd:         filepath.Join(dir, "ironic-python-agent.initramfs"),
+			ImageArchPublishURLs: "aarch64=http://arm.test:8084, ppc64le=https://power.test/images",
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	imageServer := handler.(*imageFileSystem)
+	for _, arch := range []string{hostArchitecture, "aarch64", "ppc64le"} {
+		imageServer.isoFiles[arch].size = 12345
+	}
+
+	tests := []struct {
+		arch    string
+		network string
+		want    string
+	}{
+		{arch: "", want: "http://base.test:1234/host-0.iso"},
+		{arch: "aarch64", want: "http://arm.test:8084/host-1.iso"},
+		{arch: "ppc64le", want: "https://power.test/images/host-2.iso"},
+		{arch: "aarch64", network: "mgmt", want: "http://mgmt.test:1234/host-3.iso"},
+	}
+	for i, tt := range tests {
+		imageURL, err := handler.ServeImage(fmt.Sprintf("host-%d.iso", i), tt.arch, "", tt.network, []byte{}, nil, false, true)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if imageURL != tt.want {
+			t.Errorf("unexpected url %s for %s (should be %s)", imageURL, tt.arch, tt.want)
+		}
+	}
+
+	_, err = NewImageHandler(zap.New(zap.UseDevMode(true)), baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:            filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd:         filepath.Join(dir, "ironic-python-agent.initramfs"),
+			ImageArchPublishURLs: "aarch64=ftp://arm.test",
+		})
+	if err == nil {
+		t.Error("expected an error for an invalid architecture publish URL")
+	}
+}
+
+func TestResolveURLHost(t *testing.T) {
+	lookupHost = func(host string) ([]string, error) {
+		switch host {
+		case "images.example.com":
+			return []string{"192.0.2.1"}, nil
+		case "images6.example.com":
+			return []string{"2001:db8::1"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	defer func() { lookupHost = net.LookupHost }()
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "hostname", input: "http://images.example.com:8084", want: "http://192.0.2.1:8084"},
+		{name: "no port", input: "http://images.example.com/path", want: "http://192.0.2.1/path"},
+		{name: "ipv6", input: "http://images6.example.com:8084", want: "http://[2001:db8::1]:8084"},
+		{name: "ipv6 no port", input: "http://images6.example.com", want: "http://[2001:db8::1]"},
+		{name: "ip address", input: "http://198.51.100.1:8084", want: "http://198.51.100.1:8084"},
+		{name: "unresolvable", input: "http://unknown.example.com:8084", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse(tt.input)
+			got, err := ResolveURLHost(u)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveURLHost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ResolveURLHost() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChecksumFormats(t *testing.T) {
+	dir := t.TempDir()
+	initramfs := filepath.Join(dir, "ironic-python-agent.initramfs")
+	if err := os.WriteFile(initramfs, []byte("initramfs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:            filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd:         initramfs,
+			ImageChecksumFormats: "hex,prefixed,sum",
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := handler.ServeImage("host.initramfs", "", "", "", []byte("{}"), nil, true, true); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	get := func(name string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.FileServer(handler.FileSystem()).ServeHTTP(rr, req)
+		return rr
+	}
+
+	image := get("/host.initramfs")
+	if image.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d fetching image", image.Code)
+	}
+	sum := sha256.Sum256(image.Body.Bytes())
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "/host.initramfs.sha256", want: checksum + "\n"},
+		{name: "/host.initramfs.digest", want: "sha256:" + checksum + "\n"},
+		{name: "/host.initramfs.sha256sum", want: checksum + "  host.initramfs\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := get(tt.name)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d", rr.Code)
+			}
+			if rr.Body.String() != tt.want {
+				t.Errorf("got checksum %q, want %q", rr.Body.String(), tt.want)
+			}
+		})
+	}
+
+	if rr := get("/other.initramfs.sha256"); rr.Code != http.StatusNotFound {
+		t.Errorf("unexpected status %d for checksum of unknown image", rr.Code)
+	}
+}
+
+func TestParseChecksumFormats(t *testing.T) {
+	formats, err := parseChecksumFormats("")
+	if err != nil || len(formats) != 0 {
+		t.Errorf("unexpected result for no formats: %v %v", formats, err)
+	}
+	if _, err := parseChecksumFormats("hex,md5"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestServeImageChangedIgnition(t *testing.T) {
+	dir := t.TempDir()
+	initramfs := filepath.Join(dir, "ironic-python-agent.initramfs")
+	if err := os.WriteFile(initramfs, []byte("initramfs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: initramfs,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	serve := func(ignition string) (string, string) {
+		imageURL, err := handler.ServeImage("test-key", "", "", "", []byte(ignition), nil, true, false)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		u, _ := url.Parse(imageURL)
+		req, err := http.NewRequest("GET", u.Path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.FileServer(handler.FileSystem()).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d", rr.Code)
+		}
+		return imageURL, rr.Body.String()
+	}
+
+	expected := func(ignition string) string {
+		archive, err := (&isoeditor.IgnitionContent{Config: []byte(ignition)}).Archive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(archive)
+		return "initramfs" + string(data)
+	}
+
+	url1, body1 := serve(`{"first": true}`)
+	if body1 != expected(`{"first": true}`) {
+		t.Errorf("unexpected content for first ignition")
+	}
+	url2, body2 := serve(`{"second": true}`)
+	if body2 != expected(`{"second": true}`) {
+		t.Errorf("stale content served after ignition changed")
+	}
+	if url1 != url2 {
+		t.Errorf("URL changed with ignition: %s %s", url1, url2)
+	}
+}
+
+func TestImageETag(t *testing.T) {
+	dir := t.TempDir()
+	initramfs := filepath.Join(dir, "ironic-python-agent.initramfs")
+	if err := os.WriteFile(initramfs, []byte("initramfs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: initramfs,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	get := func(ignition, ifNoneMatch string) *httptest.ResponseRecorder {
+		imageURL, err := handler.ServeImage("test-key", "", "", "", []byte(ignition), nil, true, false)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		u, _ := url.Parse(imageURL)
+		req := httptest.NewRequest(http.MethodGet, u.Path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		handler.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get(`{"first": true}`, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag returned")
+	}
+
+	rr = get(`{"first": true}`, etag)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("unexpected status %d for unchanged image", rr.Code)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("unexpected body for unchanged image")
+	}
+
+	rr = get(`{"second": true}`, etag)
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status %d after ignition changed", rr.Code)
+	}
+	newETag := rr.Header().Get("ETag")
+	if newETag == etag || newETag == "" {
+		t.Errorf("ETag not updated after ignition changed: %q", newETag)
+	}
+
+	// The base image is never read in full to compute the tag
+	if checksum := handler.(*imageFileSystem).initramfsFiles[hostArchitecture].checksum; checksum != "" {
+		t.Errorf("base image checksum computed for the ETag")
+	}
+
+	// Replacing the base image changes the tag
+	if err := os.WriteFile(initramfs, []byte("new initramfs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rr = get(`{"second": true}`, newETag)
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status %d after base image changed", rr.Code)
+	}
+	if rr.Header().Get("ETag") == newETag {
+		t.Errorf("ETag not updated after base image changed")
+	}
+}
+
+func TestMissingBaseImage(t *testing.T) {
+	dir := t.TempDir()
+	initramfs := filepath.Join(dir, "ironic-python-agent.initramfs")
+	if err := os.WriteFile(initramfs, []byte("initramfs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: initramfs,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	imageURL, err := handler.ServeImage("host", "", "", "", []byte("{}"), nil, true, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	u, _ := url.Parse(imageURL)
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, u.Path, nil))
+		return rr
+	}
+
+	if err := os.Remove(initramfs); err != nil {
+		t.Fatal(err)
+	}
+	if rr := get(); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d with base image missing", rr.Code)
+	}
+	if handler.HasImagesForArchitecture(hostArchitectureName()) {
+		t.Errorf("architecture still supported with base image missing")
+	}
+	_, err = handler.ServeImage("other-host", "", "", "", []byte("{}"), nil, true, false)
+	if !errors.As(err, &InvalidBaseImageError{}) {
+		t.Errorf("expected InvalidBaseImageError, got %v", err)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the cause to be a missing file, got %v", err)
+	}
+
+	if err := os.WriteFile(initramfs, []byte("initramfs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if rr := get(); rr.Code != http.StatusOK {
+		t.Errorf("unexpected status %d after base image returned", rr.Code)
+	}
+	if !handler.HasImagesForArchitecture(hostArchitectureName()) {
+		t.Errorf("architecture not supported after base image returned")
+	}
+}
+
+func TestCheckBaseImages(t *testing.T) {
+	dir := t.TempDir()
+	iso := filepath.Join(dir, "ironic-python-agent.iso")
+	initramfs := filepath.Join(dir, "ironic-python-agent.initramfs")
+	for _, file := range []string{iso, initramfs} {
+		if err := os.WriteFile(file, []byte("image"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    iso,
+			DeployInitrd: initramfs,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if err := handler.CheckBaseImages(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if err := os.Remove(initramfs); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.CheckBaseImages(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected missing file error, got %v", err)
+	}
+}
+
+func TestKargs(t *testing.T) {
+	dir := t.TempDir()
+	initramfs := filepath.Join(dir, "ironic-python-agent.initramfs")
+	if err := os.WriteFile(initramfs, []byte("initramfs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	iso := filepath.Join(dir, "ironic-python-agent.iso")
+	if err := os.WriteFile(iso, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    iso,
+			DeployInitrd: initramfs,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	handler.(*imageFileSystem).isoFiles[hostArchitecture].size = 12345
+
+	get := func(name string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		return rr
+	}
+
+	if _, err := handler.ServeImage("host.initramfs", "", "", "", []byte("{}"), nil, true, true); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	rr := get("host.initramfs.kargs")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	if body := rr.Body.String(); body != "ignition.firstboot ignition.platform.id=metal\n" {
+		t.Errorf("unexpected kargs %q", body)
+	}
+
+	if _, err := handler.ServeImage("host.iso", "", "", "", []byte("{}"), nil, false, true); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if rr := get("host.iso.kargs"); rr.Code != http.StatusNotFound {
+		t.Errorf("unexpected status %d for ISO kargs", rr.Code)
+	}
+	if rr := get("missing.initramfs.kargs"); rr.Code != http.StatusNotFound {
+		t.Errorf("unexpected status %d for missing image kargs", rr.Code)
+	}
+}
+
+func TestParseSerialConsole(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []string
+		wantErr bool
+	}{
+		{spec: ""},
+		{spec: "console=ttyS0,115200", want: []string{"console=ttyS0,115200"}},
+		{spec: " console=ttyS1,9600n8 ", want: []string{"console=ttyS1,9600n8"}},
+		{spec: "console=ttyAMA0,115200", want: []string{"console=ttyAMA0,115200"}},
+		{spec: "ttyS0,115200", wantErr: true},
+		{spec: "console=ttyS0", wantErr: true},
+		{spec: "console=tty0", wantErr: true},
+		{spec: "console=ttyS0,115201", wantErr: true},
+		{spec: "console=ttyS0,115200 quiet", wantErr: true},
+		{spec: "console=ttyS0,115200x8", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseSerialConsole(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// createKargsISO writes an ISO with an ignition embed area and a bootloader
+// config with a kernel arguments embed area, as in an RHCOS live ISO.
+func createKargsISO(t *testing.T, isoPath string) {
+	t.Helper()
+	workDir := t.TempDir()
+	files := map[string]string{
+		"images/ignition.img": strings.Repeat("\x00", 64*1024),
+		"coreos/kargs.json":   `{"files": [{"path": "/EFI/redhat/grub.cfg"}]}`,
+		"EFI/redhat/grub.cfg": "linux /images/pxeboot/vmlinuz coreos.liveiso=rhcos ignition.firstboot\n" +
+			strings.Repeat("#", 100) + " COREOS_KARG_EMBED_AREA\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(workDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := isoeditor.Create(isoPath, workDir, "rhcos"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeImageSerialConsole(t *testing.T) {
+	dir := t.TempDir()
+	iso := filepath.Join(dir, "ironic-python-agent.iso")
+	createKargsISO(t, iso)
+	initramfs := filepath.Join(dir, "ironic-python-agent.initramfs")
+	if err := os.WriteFile(initramfs, []byte("initramfs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fcos := filepath.Join(dir, "ironic-python-agent-fcos.aarch64.iso")
+	if err := os.WriteFile(fcos, []byte("fcos"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    iso,
+			DeployInitrd: initramfs,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	get := func(name string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		return rr
+	}
+
+	kargs := []string{"console=ttyS0,115200"}
+	if _, err := handler.ServeImage("host.iso", "", "", "", []byte("{}"), kargs, false, true); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	rr := get("host.iso")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "ignition.firstboot console=ttyS0,115200\n#") {
+		t.Error("serial console not added to the kernel arguments of the ISO")
+	}
+
+	if _, err := handler.ServeImage("plain.iso", "", "", "", []byte("{}"), nil, false, true); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if rr := get("plain.iso"); strings.Contains(rr.Body.String(), "console=") {
+		t.Error("unexpected kernel arguments added to the ISO")
+	}
+
+	if _, err := handler.ServeImage("host.initramfs", "", "", "", []byte("{}"), kargs, true, true); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if body := get("host.initramfs.kargs").Body.String(); body != "ignition.firstboot ignition.platform.id=metal console=ttyS0,115200\n" {
+		t.Errorf("unexpected kargs %q", body)
+	}
+
+	_, err = handler.ServeImage("fcos.iso", "aarch64", "", "", []byte("{}"), kargs, false, true)
+	if !errors.As(err, &InvalidBaseImageError{}) {
+		t.Errorf("expected an invalid base image error for a Fedora CoreOS ISO, got %v", err)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	dir := t.TempDir()
+	initramfs := filepath.Join(dir, "ironic-python-agent.initramfs")
+	if err := os.WriteFile(initramfs, []byte("initramfs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: initramfs,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	imageURL, err := handler.ServeImage("host", "", "", "", []byte("{}"), nil, true, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	u, _ := url.Parse(imageURL)
+
+	rr := httptest.NewRecorder()
+	handler.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, u.Path+"?passthrough=true", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	if body := rr.Body.String(); body != "initramfs" {
+		t.Errorf("unexpected passthrough content %q", body)
+	}
+	if cl := rr.Header().Get("Content-Length"); cl != "9" {
+		t.Errorf("unexpected Content-Length %q", cl)
+	}
+
+	baseChecksum, err := handler.(*imageFileSystem).initramfsFiles[hostArchitecture].Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := sha256.Sum256(rr.Body.Bytes())
+	if hex.EncodeToString(checksum[:]) != baseChecksum {
+		t.Errorf("passthrough checksum does not match the base image")
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	dir := t.TempDir()
+	initramfs := filepath.Join(dir, "ironic-python-agent.initramfs")
+	if err := os.WriteFile(initramfs, []byte("initramfs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: initramfs,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	setMaintenance := func(method string, want string) {
+		req := httptest.NewRequest(method, "/maintenance", nil)
+		rr := httptest.NewRecorder()
+		handler.MaintenanceHandler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d", rr.Code)
+		}
+		if body := strings.TrimSpace(rr.Body.String()); body != want {
+			t.Errorf("unexpected response %s", body)
+		}
+	}
+
+	existingURL, err := handler.ServeImage("existing", "", "", "", []byte("{}"), nil, true, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	setMaintenance(http.MethodPut, `{"maintenance":true}`)
+	setMaintenance(http.MethodGet, `{"maintenance":true}`)
+
+	if _, err := handler.ServeImage("new", "", "", "", []byte("{}"), nil, true, false); !errors.As(err, &MaintenanceError{}) {
+		t.Errorf("expected maintenance error building new image, got %v", err)
+	}
+	if _, err := handler.ServeImage("existing", "", "", "", []byte(`{"changed": true}`), nil, true, false); !errors.As(err, &MaintenanceError{}) {
+		t.Errorf("expected maintenance error rebuilding image, got %v", err)
+	}
+	if imageURL, err := handler.ServeImage("existing", "", "", "", []byte("{}"), nil, true, false); err != nil || imageURL != existingURL {
+		t.Errorf("unexpected result for unchanged image: %s %v", imageURL, err)
+	}
+
+	u, _ := url.Parse(existingURL)
+	rr := httptest.NewRecorder()
+	http.FileServer(handler.FileSystem()).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, u.Path, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("existing image not served in maintenance mode: %d", rr.Code)
+	}
+
+	setMaintenance(http.MethodDelete, `{"maintenance":false}`)
+	if _, err := handler.ServeImage("new", "", "", "", []byte("{}"), nil, true, false); err != nil {
+		t.Errorf("unexpected error after maintenance %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.MaintenanceHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/maintenance", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status %d", rr.Code)
+	}
+}
+
+func TestInfoHandler(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"ironic-python-agent.iso":              "host iso",
+		"ironic-python-agent.initramfs":        "host initramfs",
+		"4.15/ironic-python-agent.aarch64.iso": "aarch64 iso",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: filepath.Join(dir, "ironic-python-agent.initramfs"),
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := handler.ServeImage("host", "", "", "", []byte("{}"), nil, true, false); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.InfoHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/info", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+
+	var info struct {
+		BaseImages []baseImageInfo `json:"baseImages"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+
+	checksum := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	expected := []baseImageInfo{
+		{Architecture: "host", Type: "initramfs", Path: filepath.Join(dir, "ironic-python-agent.initramfs"),
+			Size: 14, Checksum: checksum("host initramfs")},
+		{Architecture: "host", Type: "iso", Path: filepath.Join(dir, "ironic-python-agent.iso"),
+			Size: 8, Checksum: checksum("host iso")},
+		{Architecture: "aarch64", Version: "4.15", Type: "iso", Path: filepath.Join(dir, "4.15/ironic-python-agent.aarch64.iso"),
+			Size: 11, Checksum: checksum("aarch64 iso")},
+	}
+	if !reflect.DeepEqual(info.BaseImages, expected) {
+		t.Errorf("unexpected base images %+v", info.BaseImages)
+	}
+}
+
+func TestPrecomputeChecksums(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"ironic-python-agent.iso",
+		"ironic-python-agent.initramfs",
+		"ironic-python-agent.aarch64.iso",
+		"4.15/ironic-python-agent.iso",
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: filepath.Join(dir, "ironic-python-agent.initramfs"),
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ifs := handler.(*imageFileSystem)
+
+	// Serve images while the checksums are being computed
+	done := ifs.precomputeChecksums(2)
+	for i := 0; i < 10; i++ {
+		if _, err := handler.ServeImage(fmt.Sprintf("host-%d", i), "aarch64", "", "", []byte("{}"), nil, false, false); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	<-done
+
+	files := []*baseFileData{}
+	for _, set := range append([]*baseImageSet{ifs.baseImageSet}, ifs.versions["4.15"]) {
+		for _, file := range set.isoFiles {
+			files = append(files, &file.baseFileData)
+		}
+		for _, file := range set.initramfsFiles {
+			files = append(files, &file.baseFileData)
+		}
+	}
+	if len(files) != 4 {
+		t.Fatalf("unexpected number of base images %d", len(files))
+	}
+	for _, file := range files {
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(file.filename, dir+"/")))
+		if file.checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("unexpected checksum %q for %s", file.checksum, file.filename)
+		}
+	}
+}
+
+func gaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	if err := gauge.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := counter.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestImageCacheMetrics(t *testing.T) {
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	dir := newTestBaseImageDir(t)
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: filepath.Join(dir, "ironic-python-agent.initramfs"),
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	handler.(*imageFileSystem).isoFiles[hostArchitecture].size = 12345
+
+	hits, misses := counterValue(t, imageCacheHits), counterValue(t, imageCacheMisses)
+	for _, ignition := range []string{"first", "first", "second"} {
+		if _, err := handler.ServeImage("test-key", "", "", "", []byte(ignition), nil, false, false); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	if delta := counterValue(t, imageCacheHits) - hits; delta != 1 {
+		t.Errorf("unexpected number of cache hits %v", delta)
+	}
+	if delta := counterValue(t, imageCacheMisses) - misses; delta != 2 {
+		t.Errorf("unexpected number of cache misses %v", delta)
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	handler := LimitConcurrency(slow, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/image", nil))
+		}()
+		<-started
+	}
+
+	if inFlight := gaugeValue(t, requestsInFlight); inFlight != 2 {
+		t.Errorf("unexpected number of requests in flight %v", inFlight)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/image", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d over the limit", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("no Retry-After header over the limit")
+	}
+
+	close(release)
+	wg.Wait()
+	if inFlight := gaugeValue(t, requestsInFlight); inFlight != 0 {
+		t.Errorf("unexpected number of requests in flight %v", inFlight)
+	}
+
+	go func() { <-started }()
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/image", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status %d under the limit", rr.Code)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	imageServer := newTestImageFileSystem(t)
+
+	rr := httptest.NewRecorder()
+	imageServer.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/missing.iso", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	for _, name := range []string{
+		"icc_image_cache_hits_total",
+		"icc_image_request_duration_seconds_count{code=\"404\"}",
+		"icc_image_response_size_bytes_count",
+		"icc_requests_in_flight",
+	} {
+		if !strings.Contains(rr.Body.String(), name) {
+			t.Errorf("metric %s not found in %s", name, rr.Body.String())
+		}
+	}
+}
+
+func TestImageHandlerGzip(t *testing.T) {
+	content := "initramfs content"
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		rangeHeader    string
+		wantGzip       bool
+	}{
+		{name: "initramfs", path: "/host-xyz-45.initramfs", acceptEncoding: "deflate, gzip;q=0.8", wantGzip: true},
+		{name: "no gzip", path: "/host-xyz-45.initramfs"},
+		{name: "refused", path: "/host-xyz-45.initramfs", acceptEncoding: "gzip;q=0"},
+		{name: "range", path: "/host-xyz-45.initramfs", acceptEncoding: "gzip", rangeHeader: "bytes=0-3"},
+		{name: "iso", path: "/host-xyz-46.iso", acceptEncoding: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imageServer := newTestImageFileSystem(t,
+				&imageFile{
+					name:            "host-xyz-45.initramfs",
+					size:            int64(len(content)),
+					initramfs:       true,
+					ignitionContent: []byte("asietonarst"),
+					imageReader:     nopCloser(strings.NewReader(content)),
+				},
+				&imageFile{
+					name:            "host-xyz-46.iso",
+					size:            int64(len(content)),
+					ignitionContent: []byte("asietonarst"),
+					imageReader:     nopCloser(strings.NewReader(content)),
+				})
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rr := httptest.NewRecorder()
+			imageServer.Handler().ServeHTTP(rr, req)
+
+			if !tt.wantGzip {
+				if ce := rr.Header().Get("Content-Encoding"); ce != "" {
+					t.Errorf("unexpected Content-Encoding %q", ce)
+				}
+				return
+			}
+			if rr.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d", rr.Code)
+			}
+			if ce := rr.Header().Get("Content-Encoding"); ce != "gzip" {
+				t.Errorf("unexpected Content-Encoding %q", ce)
+			}
+			if vary := rr.Header().Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("unexpected Vary %q", vary)
+			}
+			if etag := rr.Header().Get("ETag"); !strings.HasSuffix(etag, `-gzip"`) {
+				t.Errorf("unexpected ETag %q", etag)
+			}
+			gz, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			data, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if string(data) != content {
+				t.Errorf("unexpected decompressed content %q", data)
+			}
+		})
+	}
+}
+
+func TestImageHandlerCompressedISO(t *testing.T) {
+	content := "iso content"
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			im := &imageFile{
+				name:            "host-xyz-45.iso",
+				size:            int64(len(content)),
+				ignitionContent: []byte("asietonarst"),
+			}
+			imageServer := newTestImageFileSystem(t, im)
+			imageServer.compressedISOs = enabled
+
+			im.imageReader = nopCloser(strings.NewReader(content))
+			raw := httptest.NewRecorder()
+			imageServer.Handler().ServeHTTP(raw, httptest.NewRequest(http.MethodGet, "/host-xyz-45.iso", nil))
+			if raw.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d", raw.Code)
+			}
+
+			im.imageReader = nopCloser(strings.NewReader(content))
+			rr := httptest.NewRecorder()
+			imageServer.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/host-xyz-45.iso.gz", nil))
+			if !enabled {
+				if rr.Code != http.StatusNotFound {
+					t.Errorf("unexpected status %d", rr.Code)
+				}
+				return
+			}
+			if rr.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d", rr.Code)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/gzip" {
+				t.Errorf("unexpected Content-Type %q", ct)
+			}
+			if ce := rr.Header().Get("Content-Encoding"); ce != "" {
+				t.Errorf("unexpected Content-Encoding %q", ce)
+			}
+			gz, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			data, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if string(data) != raw.Body.String() {
+				t.Errorf("decompressed content %q does not match the raw image %q", data, raw.Body.String())
+			}
+		})
+	}
+}
+
+func TestCheckResponsive(t *testing.T) {
+	imageServer := newTestImageFileSystem(t)
+	imageServer.lockProbeTimeout = 50 * time.Millisecond
+	if err := imageServer.CheckResponsive(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	imageServer.mu.Lock()
+	if err := imageServer.CheckResponsive(); err == nil {
+		t.Error("expected an error while the lock is held")
+	}
+
+	// A lock released within the timeout is not a deadlock.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		imageServer.mu.Unlock()
+	}()
+	if err := imageServer.CheckResponsive(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRemoteIgnition(t *testing.T) {
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	dir := newTestBaseImageDir(t)
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:       filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd:    filepath.Join(dir, "ironic-python-agent.initramfs"),
+			RemoteIgnition:  true,
+			MaxIgnitionSize: 4,
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	imageServer := handler.(*imageFileSystem)
+	imageServer.isoFiles[hostArchitecture].size = 12345
+
+	ignitionContent := []byte(`{"ignition":{"version":"3.2.0"}}`)
+	imageURL, err := handler.ServeImage("host-xyz-45.iso", "", "", "", ignitionContent, nil, false, true)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	im := imageServer.imageFileByName("host-xyz-45.iso")
+	var pointer ignition_config_types_32.Config
+	if err := json.Unmarshal(im.embeddedIgnition(), &pointer); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(pointer.Ignition.Config.Merge) != 1 {
+		t.Fatalf("unexpected embedded ignition %s", im.embeddedIgnition())
+	}
+	source := *pointer.Ignition.Config.Merge[0].Source
+	if want := "http://base.test:1234/ignition/host-xyz-45.iso"; source != want {
+		t.Errorf("unexpected ignition source %s (should be %s)", source, want)
+	}
+	hash := sha512.Sum512(ignitionContent)
+	if want := "sha512-" + hex.EncodeToString(hash[:]); *pointer.Ignition.Config.Merge[0].Verification.Hash != want {
+		t.Errorf("unexpected ignition hash %s", *pointer.Ignition.Config.Merge[0].Verification.Hash)
+	}
+	if imageURL != "http://base.test:1234/host-xyz-45.iso" {
+		t.Errorf("unexpected image url %s", imageURL)
+	}
+
+	sourceURL, _ := url.Parse(source)
+	rr := httptest.NewRecorder()
+	handler.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, sourceURL.Path, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if rr.Body.String() != string(ignitionContent) {
+		t.Errorf("unexpected ignition %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/ignition/missing.iso", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unexpected status %d", rr.Code)
+	}
+}
+
+func TestNormalizeArch(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"ironic-python-agent.iso",
+		"ironic-python-agent.initramfs",
+		"ironic-python-agent.x86_64.iso",
+		"ironic-python-agent.arm64.iso",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	baseUrl, _ := url.Parse("http://base.test:1234")
+	handler, err := NewImageHandler(zap.New(zap.UseDevMode(true)),
+		baseUrl, nil,
+		&env.EnvInputs{
+			DeployISO:    filepath.Join(dir, "ironic-python-agent.iso"),
+			DeployInitrd: filepath.Join(dir, "ironic-python-agent.initramfs"),
+		})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ifs := handler.(*imageFileSystem)
+
+	tests := []struct {
+		arch string
+		want string
+	}{
+		{arch: "x86_64", want: "ironic-python-agent.x86_64.iso"},
+		{arch: "amd64", want: "ironic-python-agent.x86_64.iso"},
+		{arch: "aarch64", want: "ironic-python-agent.arm64.iso"},
+		{arch: "arm64", want: "ironic-python-agent.arm64.iso"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arch, func(t *testing.T) {
+			if !handler.HasImagesForArchitecture(tt.arch) {
+				t.Errorf("no images for architecture %s", tt.arch)
+			}
+			got := ifs.getBaseImage(tt.arch, "", false)
+			if got == nil || got.Path() != filepath.Join(dir, tt.want) {
+				t.Errorf("unexpected base image %v, want %s", got, tt.want)
+			}
+		})
+	}
+	if _, exists := ifs.baseImageSet.isoFiles["arm64"]; exists {
+		t.Error("base image indexed under the arm64 alias")
+	}
+	if handler.HasImagesForArchitecture("ppc64le") {
+		t.Error("unexpected images for architecture ppc64le")
+	}
+
+	for alias, want := range map[string]string{"amd64": "x86_64", "arm64": "aarch64", "x86_64": "x86_64", "s390x": "s390x", "": ""} {
+		if got := normalizeArch(alias); got != want {
+			t.Errorf("normalizeArch(%q) = %q, want %q", alias, got, want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package imagehandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// baseImageInfo describes a base image that images are built from.
+type baseImageInfo struct {
+	Architecture string `json:"architecture"`
+	Version      string `json:"version,omitempty"`
+	Type         string `json:"type"`
+	Path         string `json:"path"`
+	Size         int64  `json:"size,omitempty"`
+	Checksum     string `json:"sha256,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+func newBaseImageInfo(arch, version, fileType string, file *baseFileData) baseImageInfo {
+	info := baseImageInfo{
+		Architecture: arch,
+		Version:      version,
+		Type:         fileType,
+		Path:         file.filename,
+	}
+	var err error
+	if info.Size, err = file.Size(); err == nil {
+		info.Checksum, err = file.Checksum()
+	}
+	if err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
+
+func (s *baseImageSet) info(version string) []baseImageInfo {
+	result := []baseImageInfo{}
+	for arch, file := range s.isoFiles {
+		result = append(result, newBaseImageInfo(arch, version, "iso", &file.baseFileData))
+	}
+	for arch, file := range s.initramfsFiles {
+		result = append(result, newBaseImageInfo(arch, version, "initramfs", &file.baseFileData))
+	}
+	return result
+}
+
+// baseImagesInfo returns a description of all of the base images, in a stable
+// order.
+func (f *imageFileSystem) baseImagesInfo() []baseImageInfo {
+	f.mu.Lock()
+	sets := map[string]*baseImageSet{"": f.baseImageSet}
+	for version, set := range f.versions {
+		sets[version] = set
+	}
+	f.mu.Unlock()
+
+	result := []baseImageInfo{}
+	for version, set := range sets {
+		result = append(result, set.info(version)...)
+	}
+	slices.SortFunc(result, func(a, b baseImageInfo) int {
+		if c := compareVersions(a.Version, b.Version); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Architecture, b.Architecture); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Type, b.Type)
+	})
+	return result
+}
+
+// InfoHandler returns an http.Handler that reports the base images, with
+// their size and SHA256 checksum, as JSON. Images built for hosts are not
+// included.
+func (f *imageFileSystem) InfoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			BaseImages []baseImageInfo `json:"baseImages"`
+		}{f.baseImagesInfo()})
+	})
+}
+
+// precomputeChecksums computes the checksums of all of the base images in the
+// background, reading at most concurrency files at a time. The returned
+// channel is closed once all of them are done.
+func (f *imageFileSystem) precomputeChecksums(concurrency int) <-chan struct{} {
+	f.mu.Lock()
+	sets := []*baseImageSet{f.baseImageSet}
+	for _, set := range f.versions {
+		sets = append(sets, set)
+	}
+	f.mu.Unlock()
+
+	files := []*baseFileData{}
+	for _, set := range sets {
+		for _, file := range set.isoFiles {
+			files = append(files, &file.baseFileData)
+		}
+		for _, file := range set.initramfsFiles {
+			files = append(files, &file.baseFileData)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		sem := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+		for _, file := range files {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(file *baseFileData) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				if _, err := file.Checksum(); err != nil {
+					f.log.Error(err, "failed to compute base image checksum", "path", file.filename)
+				}
+			}(file)
+		}
+		wg.Wait()
+		f.log.Info("computed base image checksums", "count", len(files))
+	}()
+	return done
+}
@@ -0,0 +1,91 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package imagehandler
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// kargsSuffix is appended to the URL of an initramfs image to download the
+// kernel arguments to boot it with.
+const kargsSuffix = ".kargs"
+
+// initramfsKargs are the kernel arguments needed to boot a CoreOS initramfs
+// with an appended ignition. An ISO carries them in its own bootloader
+// config, but for an initramfs they must be passed by whatever boots it, e.g.
+// an iPXE script.
+var initramfsKargs = []string{
+	"ignition.firstboot",
+	"ignition.platform.id=metal",
+}
+
+// openKargs returns the kernel arguments file with the given name, if it is
+// one.
+func (f *imageFileSystem) openKargs(name string) *textFile {
+	if !strings.HasSuffix(name, kargsSuffix) {
+		return nil
+	}
+	im := f.imageFileByName(strings.TrimSuffix(name, kargsSuffix))
+	if im == nil || !im.initramfs {
+		return nil
+	}
+	kargs := append(append([]string{}, initramfsKargs...), im.kargs...)
+	return newTextFile(name, strings.Join(kargs, " ")+"\n")
+}
+
+// serialConsoleRegexp matches a serial console kernel argument, with an
+// optional parity and word length after the baud rate, e.g. console=ttyS0,115200
+// or console=ttyS1,9600n8.
+var serialConsoleRegexp = regexp.MustCompile(`^console=([A-Za-z][A-Za-z0-9]*),([0-9]+)(?:[noe][5-8])?$`)
+
+// serialBaudRates are the baud rates accepted for a serial console.
+var serialBaudRates = map[string]bool{
+	"9600":   true,
+	"19200":  true,
+	"38400":  true,
+	"57600":  true,
+	"115200": true,
+	"230400": true,
+	"460800": true,
+	"921600": true,
+}
+
+// ParseSerialConsole validates a serial console kernel argument of the form
+// console=<dev>,<baud>, e.g. console=ttyS0,115200, and returns the kernel
+// arguments to add to an image for it. An empty spec adds none.
+func ParseSerialConsole(spec string) ([]string, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	match := serialConsoleRegexp.FindStringSubmatch(spec)
+	if match == nil {
+		return nil, fmt.Errorf("invalid serial console %q, expected console=<dev>,<baud>", spec)
+	}
+	if !serialBaudRates[match[2]] {
+		return nil, fmt.Errorf("invalid serial console %q: unsupported baud rate %s", spec, match[2])
+	}
+	return []string{spec}, nil
+}
+
+// isoKargs returns the content written to the kernel arguments embed area of
+// an ISO to append kargs to its boot entries, or nil if there are none.
+func isoKargs(kargs []string) []byte {
+	if len(kargs) == 0 {
+		return nil
+	}
+	return []byte(" " + strings.Join(kargs, " ") + "\n")
+}
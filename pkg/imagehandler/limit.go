@@ -0,0 +1,59 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package imagehandler
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// busyRetryAfter is the number of seconds clients are asked to wait before
+// retrying a request refused because too many are in progress.
+const busyRetryAfter = "10"
+
+var requestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "icc_requests_in_flight",
+	Help: "Number of requests to the images server currently being served.",
+})
+
+func init() {
+	registerImageMetrics(requestsInFlight)
+}
+
+// LimitConcurrency returns an http.Handler that serves at most limit requests
+// at once using handler, refusing any more with 503 Service Unavailable. A
+// limit of zero or less disables the limit.
+func LimitConcurrency(handler http.Handler, limit int) http.Handler {
+	var sem chan struct{}
+	if limit > 0 {
+		sem = make(chan struct{}, limit)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			default:
+				w.Header().Set("Retry-After", busyRetryAfter)
+				http.Error(w, "too many requests in progress", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec()
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,69 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package imagehandler
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// MaintenanceError is returned when an image cannot be built because the
+// image handler is in maintenance mode. The build should be retried later.
+type MaintenanceError struct{}
+
+func (me MaintenanceError) Error() string {
+	return "image builds are paused for maintenance"
+}
+
+func (f *imageFileSystem) setMaintenance(maintenance bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if maintenance != f.maintenance {
+		f.log.Info("changing maintenance mode", "maintenance", maintenance)
+	}
+	f.maintenance = maintenance
+}
+
+func (f *imageFileSystem) inMaintenance() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.maintenance
+}
+
+// MaintenanceHandler returns an http.Handler that controls maintenance mode.
+// While in maintenance mode, no new images are built but existing images
+// continue to be served. A PUT request enables it, a DELETE request disables
+// it and a GET request reports whether it is enabled.
+func (f *imageFileSystem) MaintenanceHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPut:
+			f.setMaintenance(true)
+		case http.MethodDelete:
+			f.setMaintenance(false)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Maintenance bool `json:"maintenance"`
+		}{f.inMaintenance()})
+	})
+}
@@ -0,0 +1,72 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package imagehandler
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	imageCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "icc_image_cache_hits_total",
+		Help: "Number of requests to serve an image that reused an existing image with the same inputs.",
+	})
+	imageCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "icc_image_cache_misses_total",
+		Help: "Number of requests to serve an image that created a new image or replaced one with changed inputs.",
+	})
+	imageRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "icc_image_request_duration_seconds",
+		Help:    "Time taken to serve requests to the images server.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"code"})
+	imageResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "icc_image_response_size_bytes",
+		Help:    "Number of bytes sent in responses from the images server.",
+		Buckets: prometheus.ExponentialBuckets(1024, 8, 9),
+	}, []string{})
+)
+
+// imagesRegistry holds the metrics of the images server alone, so that they
+// can be served by its own listener independently of the controller manager.
+var imagesRegistry = prometheus.NewRegistry()
+
+// registerImageMetrics registers collectors with both the controller-runtime
+// registry and the images server registry.
+func registerImageMetrics(collectors ...prometheus.Collector) {
+	metrics.Registry.MustRegister(collectors...)
+	imagesRegistry.MustRegister(collectors...)
+}
+
+func init() {
+	registerImageMetrics(imageCacheHits, imageCacheMisses,
+		imageRequestDuration, imageResponseSize)
+}
+
+// instrumentImageHandler records the duration and size of responses served by
+// handler.
+func instrumentImageHandler(handler http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(imageRequestDuration,
+		promhttp.InstrumentHandlerResponseSize(imageResponseSize, handler))
+}
+
+// MetricsHandler returns an http.Handler that serves the metrics of the
+// images server in the Prometheus exposition format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(imagesRegistry, promhttp.HandlerOpts{})
+}
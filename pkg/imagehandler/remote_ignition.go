@@ -0,0 +1,78 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package imagehandler
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+
+	ignition_config_types_32 "github.com/coreos/ignition/v2/config/v3_2/types"
+)
+
+// remoteIgnitionPath is the path segment under which the full ignition config
+// of each image is served when images embed only a reference to it.
+const remoteIgnitionPath = "ignition"
+
+// remoteIgnitionURL returns the URL the full ignition config of the image with
+// the given name is served at.
+func remoteIgnitionURL(baseURL *url.URL, name string) string {
+	return baseURL.JoinPath(remoteIgnitionPath, name).String()
+}
+
+// pointerIgnition returns an ignition config that merges the full config from
+// source, verified against its hash, to embed in an image instead of the full
+// config.
+func pointerIgnition(source string, ignitionContent []byte) ([]byte, error) {
+	hash := sha512.Sum512(ignitionContent)
+	verification := "sha512-" + hex.EncodeToString(hash[:])
+	config := ignition_config_types_32.Config{
+		Ignition: ignition_config_types_32.Ignition{
+			Version: "3.2.0",
+			Config: ignition_config_types_32.IgnitionConfig{
+				Merge: []ignition_config_types_32.Resource{{
+					Source:       &source,
+					Verification: ignition_config_types_32.Verification{Hash: &verification},
+				}},
+			},
+		},
+	}
+	return json.Marshal(config)
+}
+
+// serveIgnition serves the full ignition config of the image with the given
+// name, if the image embeds only a reference to it.
+func (f *imageFileSystem) serveIgnition(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	im := f.imageFileByName(path.Base(name))
+	if im == nil || im.pointerIgnition == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(im.ignitionContent); err != nil {
+		f.log.Error(err, "failed to serve ignition", "name", im.name)
+	}
+}
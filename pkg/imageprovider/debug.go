@@ -0,0 +1,89 @@
+package imageprovider
+
+import (
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+	"github.com/metal3-io/baremetal-operator/pkg/imageprovider"
+)
+
+// IgnitionRenderer is implemented by image providers that can produce the
+// ignition config for a host without building an image.
+type IgnitionRenderer interface {
+	RenderIgnition(data imageprovider.ImageData, networkData imageprovider.NetworkData) ([]byte, error)
+}
+
+var _ IgnitionRenderer = &rhcosImageProvider{}
+
+// RenderIgnition returns the ignition config that would be built into the
+// image for a host, without building or serving the image.
+func (ip *rhcosImageProvider) RenderIgnition(data imageprovider.ImageData, networkData imageprovider.NetworkData) ([]byte, error) {
+	arch, err := ip.imageArchitecture(data)
+	if err != nil {
+		return nil, err
+	}
+	return ip.buildIgnitionConfig(networkData, data.ImageMetadata.Name, arch)
+}
+
+// DebugIgnitionHandler returns an http.Handler that renders the ignition
+// config for the PreprovisioningImage at /debug/ignition/<namespace>/<name>,
+// using its current network data.
+func DebugIgnitionHandler(renderer IgnitionRenderer, reader client.Reader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/debug/ignition/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			http.Error(w, "expected /debug/ignition/<namespace>/<name>", http.StatusNotFound)
+			return
+		}
+		key := types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+
+		img := &metal3.PreprovisioningImage{}
+		if err := reader.Get(r.Context(), key, img); err != nil {
+			writeClientError(w, err)
+			return
+		}
+
+		var networkData imageprovider.NetworkData
+		if img.Spec.NetworkDataName != "" {
+			secret := &corev1.Secret{}
+			secretKey := types.NamespacedName{Namespace: key.Namespace, Name: img.Spec.NetworkDataName}
+			if err := reader.Get(r.Context(), secretKey, secret); err != nil {
+				writeClientError(w, err)
+				return
+			}
+			networkData = secret.Data
+		}
+
+		ignition, err := renderer.RenderIgnition(imageprovider.ImageData{
+			ImageMetadata: img.ObjectMeta.DeepCopy(),
+			Architecture:  img.Spec.Architecture,
+		}, networkData)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(ignition)
+	})
+}
+
+func writeClientError(w http.ResponseWriter, err error) {
+	if k8serrors.IsNotFound(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
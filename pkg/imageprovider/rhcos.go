@@ -1,9 +1,10 @@
 package imageprovider
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"strings"
+	"sync"
 
 	"github.com/go-logr/logr"
 
@@ -14,27 +15,83 @@ import (
 	"github.com/openshift/image-customization-controller/pkg/imagehandler"
 )
 
+// imageVersionAnnotation selects the release version of the base image used
+// to build the image for a host. If it is not set, the default base image is
+// used.
+const imageVersionAnnotation = "baremetal.openshift.io/image-version"
+
+// imagePublishNetworkAnnotation selects the network whose publish URL is used
+// for the image URL of a host, e.g. a management network that its BMC can
+// reach. If it is not set, the default publish URL is used.
+const imagePublishNetworkAnnotation = "baremetal.openshift.io/image-publish-network"
+
+// imageArchitectureAnnotation overrides the architecture of the base image
+// used to build the image for a host, for hosts that report the wrong
+// architecture. If it is not set, the reported architecture is used.
+const imageArchitectureAnnotation = "baremetal.openshift.io/image-architecture"
+
+// serialConsoleAnnotation sets the serial console kernel argument added to the
+// image of a host, e.g. console=ttyS0,115200 for access over IPMI
+// Serial-over-LAN. If it is not set, the SERIAL_CONSOLE environment variable
+// is used.
+const serialConsoleAnnotation = "baremetal.openshift.io/serial-console"
+
+// imageRebuildAnnotation forces the image of a host to be rebuilt, under a new
+// URL, whenever its value changes, e.g. to pick up changed ignition overrides
+// without recreating the host. Its value is not otherwise interpreted.
+const imageRebuildAnnotation = "baremetal.openshift.io/image-rebuild"
+
 type rhcosImageProvider struct {
-	ImageHandler   imagehandler.ImageHandler
-	EnvInputs      *env.EnvInputs
-	RegistriesConf []byte
+	// ctx aborts building images when canceled. The ImageProvider interface
+	// passes no context to BuildImage, so the controller's is used.
+	ctx           context.Context
+	ImageHandler  imagehandler.ImageHandler
+	Ignition      *ignition.Template
+	SerialConsole []string
+
+	// hosts records the UID and image keys last served for each host, by
+	// namespace and name, so that the images of a host that is deleted and
+	// recreated with a new UID are removed.
+	hosts   map[string]hostImages
+	hostsMu sync.Mutex
+}
+
+// hostImages is the set of image keys served for one UID of a host, with the
+// value of the rebuild annotation each was last served with.
+type hostImages struct {
+	uid  string
+	keys map[string]string
 }
 
-func NewRHCOSImageProvider(imageServer imagehandler.ImageHandler, inputs *env.EnvInputs) imageprovider.ImageProvider {
-	registries, err := inputs.RegistriesConf()
+// NewRHCOSImageProvider returns an ImageProvider building images with the
+// ignition configured in inputs. The settings are validated here, so that
+// invalid ones are reported at startup rather than when building an image.
+func NewRHCOSImageProvider(ctx context.Context, imageServer imagehandler.ImageHandler, inputs *env.EnvInputs) (imageprovider.ImageProvider, error) {
+	template, err := ignition.NewTemplate(inputs, inputs.IronicAgentPullSecret)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return &rhcosImageProvider{
-		ImageHandler:   imageServer,
-		EnvInputs:      inputs,
-		RegistriesConf: registries,
+	serialConsole, err := imagehandler.ParseSerialConsole(inputs.SerialConsole)
+	if err != nil {
+		return nil, err
 	}
+
+	return &rhcosImageProvider{
+		ctx:           ctx,
+		ImageHandler:  imageServer,
+		Ignition:      template,
+		SerialConsole: serialConsole,
+	}, nil
 }
 
+// SupportsArchitecture returns whether there is a base image for the
+// architecture a host reports. The reconciler checks it without the
+// annotations of the host, so the imageArchitectureAnnotation override cannot
+// make an image build for a host whose reported architecture has no base
+// image.
 func (ip *rhcosImageProvider) SupportsArchitecture(arch string) bool {
-	return true
+	return ip.ImageHandler.HasImagesForArchitecture(arch)
 }
 
 func (ip *rhcosImageProvider) SupportsFormat(format metal3.ImageFormat) bool {
@@ -46,41 +103,44 @@ func (ip *rhcosImageProvider) SupportsFormat(format metal3.ImageFormat) bool {
 	}
 }
 
-func (ip *rhcosImageProvider) buildIgnitionConfig(networkData imageprovider.NetworkData, hostname string) ([]byte, error) {
-	nmstateData := networkData["nmstate"]
+// invalidNetworkDataError reports why the network data of a host is invalid.
+// The message is shown as is, while the error that caused it remains
+// available to errors.Is and errors.As.
+type invalidNetworkDataError struct {
+	message string
+	cause   error
+}
+
+func (e invalidNetworkDataError) Error() string {
+	return e.message
+}
 
-	additionalNTPServers := []string{}
-	if ip.EnvInputs.AdditionalNTPServers != "" {
-		additionalNTPServers = strings.Split(ip.EnvInputs.AdditionalNTPServers, ",")
-	}
+func (e invalidNetworkDataError) Unwrap() error {
+	return e.cause
+}
 
-	builder, err := ignition.New(nmstateData, ip.RegistriesConf,
-		ip.EnvInputs.IronicBaseURL,
-		ip.EnvInputs.IronicInspectorBaseURL,
-		ip.EnvInputs.IronicAgentImage,
-		ip.EnvInputs.IronicAgentPullSecret,
-		ip.EnvInputs.IronicRAMDiskSSHKey,
-		ip.EnvInputs.IpOptions,
-		ip.EnvInputs.HttpProxy,
-		ip.EnvInputs.HttpsProxy,
-		ip.EnvInputs.NoProxy,
-		hostname,
-		ip.EnvInputs.IronicAgentVlanInterfaces,
-		additionalNTPServers,
-	)
+func (ip *rhcosImageProvider) buildIgnitionConfig(networkData imageprovider.NetworkData, hostname, arch string) ([]byte, error) {
+	builder, err := ip.Ignition.Builder(networkData["nmstate"], hostname, arch)
 	if err != nil {
 		return nil, imageprovider.BuildInvalidError(err)
 	}
+	if ip.ctx != nil {
+		builder.SetContext(ip.ctx)
+	}
 
 	err, message := builder.ProcessNetworkState()
 	if message != "" {
-		return nil, imageprovider.BuildInvalidError(errors.New(message))
+		return nil, imageprovider.BuildInvalidError(invalidNetworkDataError{message: message, cause: err})
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	return builder.Generate()
+	ignitionConfig, err := builder.Generate()
+	if errors.As(err, &ignition.InvalidConfigError{}) {
+		return nil, imageprovider.BuildInvalidError(err)
+	}
+	return ignitionConfig, err
 }
 
 func imageKey(data imageprovider.ImageData) string {
@@ -93,23 +153,146 @@ func imageKey(data imageprovider.ImageData) string {
 	)
 }
 
+// rebuildRequested returns whether an image with the given key has been served
+// for the host with a value of the rebuild annotation other than rebuild.
+// Clearing the annotation does not request a rebuild.
+func (ip *rhcosImageProvider) rebuildRequested(data imageprovider.ImageData, key, rebuild string) bool {
+	if rebuild == "" {
+		return false
+	}
+
+	ip.hostsMu.Lock()
+	defer ip.hostsMu.Unlock()
+
+	images, ok := ip.hosts[data.ImageMetadata.Namespace+"/"+data.ImageMetadata.Name]
+	if !ok || images.uid != string(data.ImageMetadata.UID) {
+		return false
+	}
+	served, ok := images.keys[key]
+	return ok && served != rebuild
+}
+
+// trackImage records that the image with the given key was served for a host
+// with the given value of the rebuild annotation, and returns the keys of any
+// images served for a previous UID of the host, which are stale.
+func (ip *rhcosImageProvider) trackImage(data imageprovider.ImageData, key, rebuild string) (stale []string) {
+	ip.hostsMu.Lock()
+	defer ip.hostsMu.Unlock()
+
+	if ip.hosts == nil {
+		ip.hosts = map[string]hostImages{}
+	}
+	host := data.ImageMetadata.Namespace + "/" + data.ImageMetadata.Name
+	images, ok := ip.hosts[host]
+	if !ok || images.uid != string(data.ImageMetadata.UID) {
+		for k := range images.keys {
+			stale = append(stale, k)
+		}
+		images = hostImages{uid: string(data.ImageMetadata.UID), keys: map[string]string{}}
+		ip.hosts[host] = images
+	}
+	images.keys[key] = rebuild
+	return stale
+}
+
+// untrackImage forgets the image with the given key of a host.
+func (ip *rhcosImageProvider) untrackImage(data imageprovider.ImageData, key string) {
+	ip.hostsMu.Lock()
+	defer ip.hostsMu.Unlock()
+
+	host := data.ImageMetadata.Namespace + "/" + data.ImageMetadata.Name
+	images, ok := ip.hosts[host]
+	if !ok || images.uid != string(data.ImageMetadata.UID) {
+		return
+	}
+	delete(images.keys, key)
+	if len(images.keys) == 0 {
+		delete(ip.hosts, host)
+	}
+}
+
+// imageArchitecture returns the architecture of the base image to build the
+// image for a host from: the one in its imageArchitectureAnnotation if it has
+// one, or otherwise the architecture it reports. It is an invalid build if
+// there is no base image for that architecture.
+func (ip *rhcosImageProvider) imageArchitecture(data imageprovider.ImageData) (string, error) {
+	arch := data.Architecture
+	if override := data.ImageMetadata.Annotations[imageArchitectureAnnotation]; override != "" && override != arch {
+		if !ip.ImageHandler.HasImagesForArchitecture(override) {
+			return "", imageprovider.BuildInvalidError(
+				fmt.Errorf("no base image for architecture %q from the %s annotation", override, imageArchitectureAnnotation))
+		}
+		return override, nil
+	}
+	if !ip.ImageHandler.HasImagesForArchitecture(arch) {
+		return "", imageprovider.BuildInvalidError(fmt.Errorf("no base image for architecture %q", arch))
+	}
+	return arch, nil
+}
+
 func (ip *rhcosImageProvider) BuildImage(data imageprovider.ImageData, networkData imageprovider.NetworkData, log logr.Logger) (imageprovider.GeneratedImage, error) {
 	generated := imageprovider.GeneratedImage{}
-	ignitionConfig, err := ip.buildIgnitionConfig(networkData, data.ImageMetadata.Name)
+	log = log.WithValues(
+		"host", data.ImageMetadata.Namespace+"/"+data.ImageMetadata.Name,
+		"uid", data.ImageMetadata.UID,
+		"arch", data.Architecture,
+		"format", data.Format)
+
+	arch, err := ip.imageArchitecture(data)
+	if err != nil {
+		log.Info("image architecture not supported", "error", err.Error())
+		return generated, err
+	}
+	if arch != data.Architecture {
+		log.Info("overriding host architecture from annotation", "override", arch)
+		log = log.WithValues("arch", arch)
+	}
+
+	ignitionConfig, err := ip.buildIgnitionConfig(networkData, data.ImageMetadata.Name, arch)
 	if err != nil {
 		return generated, err
 	}
 
-	url, err := ip.ImageHandler.ServeImage(imageKey(data), ignitionConfig,
+	kargs := ip.SerialConsole
+	if console, exists := data.ImageMetadata.Annotations[serialConsoleAnnotation]; exists {
+		if kargs, err = imagehandler.ParseSerialConsole(console); err != nil {
+			return generated, imageprovider.BuildInvalidError(
+				fmt.Errorf("%s annotation: %w", serialConsoleAnnotation, err))
+		}
+	}
+
+	key := imageKey(data)
+	rebuild := data.ImageMetadata.Annotations[imageRebuildAnnotation]
+	if ip.rebuildRequested(data, key, rebuild) {
+		log.Info("discarding image to force a rebuild", "key", key, "rebuild", rebuild)
+		ip.ImageHandler.RemoveImage(key)
+	}
+	url, err := ip.ImageHandler.ServeImage(key, arch,
+		data.ImageMetadata.Annotations[imageVersionAnnotation],
+		data.ImageMetadata.Annotations[imagePublishNetworkAnnotation], ignitionConfig, kargs,
 		data.Format == metal3.ImageFormatInitRD, false)
 	if errors.As(err, &imagehandler.InvalidBaseImageError{}) {
+		log.Info("no base image available for host", "error", err.Error())
+		return generated, imageprovider.BuildInvalidError(err)
+	}
+	if errors.As(err, &imagehandler.UnknownNetworkError{}) || errors.As(err, &imagehandler.IgnitionTooLargeError{}) {
 		return generated, imageprovider.BuildInvalidError(err)
 	}
+	if err != nil {
+		return generated, err
+	}
+	for _, staleKey := range ip.trackImage(data, key, rebuild) {
+		log.Info("removing image of previous host with the same name", "key", staleKey)
+		ip.ImageHandler.RemoveImage(staleKey)
+	}
+	log.Info("built image for host", "url", url)
 	generated.ImageURL = url
-	return generated, err
+	return generated, nil
 }
 
 func (ip *rhcosImageProvider) DiscardImage(data imageprovider.ImageData) error {
-	ip.ImageHandler.RemoveImage(imageKey(data))
+	key := imageKey(data)
+	ip.ImageHandler.RemoveImage(key)
+	ip.untrackImage(data, key)
 	return nil
 }
@@ -0,0 +1,895 @@
+package imageprovider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+	metal3iocontroller "github.com/metal3-io/baremetal-operator/controllers/metal3.io"
+	"github.com/metal3-io/baremetal-operator/pkg/imageprovider"
+	"github.com/openshift/image-customization-controller/pkg/env"
+	"github.com/openshift/image-customization-controller/pkg/ignition"
+	"github.com/openshift/image-customization-controller/pkg/imagehandler"
+)
+
+type fakeImageHandler struct {
+	arch    string
+	version string
+	kargs   []string
+	removed []string
+}
+
+var _ imagehandler.ImageHandler = &fakeImageHandler{}
+
+func (f *fakeImageHandler) FileSystem() http.FileSystem { return nil }
+func (f *fakeImageHandler) Handler() http.Handler       { return nil }
+func (f *fakeImageHandler) ServeImage(key, arch, version, network string, ignitionContent []byte, kargs []string, initramfs, static bool) (string, error) {
+	f.arch = arch
+	f.version = version
+	f.kargs = kargs
+	return "http://example.com/" + key, nil
+}
+func (f *fakeImageHandler) RemoveImage(key string) { f.removed = append(f.removed, key) }
+func (f *fakeImageHandler) HasImagesForArchitecture(arch string) bool {
+	return arch == "x86_64" || arch == "aarch64"
+}
+func (f *fakeImageHandler) MaintenanceHandler() http.Handler { return nil }
+func (f *fakeImageHandler) InfoHandler() http.Handler        { return nil }
+func (f *fakeImageHandler) CheckBaseImages() error           { return nil }
+func (f *fakeImageHandler) CheckResponsive() error           { return nil }
+
+func newTestTemplate(t *testing.T, inputs *env.EnvInputs) *ignition.Template {
+	t.Helper()
+	template, err := ignition.NewTemplate(inputs, inputs.IronicAgentPullSecret)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return template
+}
+
+func TestBuildImageVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantVersion string
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:        "annotated",
+			annotations: map[string]string{imageVersionAnnotation: "4.13"},
+			wantVersion: "4.13",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &fakeImageHandler{}
+			ip := &rhcosImageProvider{
+				ImageHandler: handler,
+				Ignition: newTestTemplate(t, &env.EnvInputs{
+					IronicBaseURL:     "http://ironic.example.com",
+					IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+					InsecureIronicTLS: true,
+				}),
+			}
+			data := imageprovider.ImageData{
+				ImageMetadata: &metav1.ObjectMeta{
+					Name:        "host",
+					Namespace:   "ns",
+					Annotations: tt.annotations,
+				},
+				Format:       metal3.ImageFormatISO,
+				Architecture: "x86_64",
+			}
+			if _, err := ip.BuildImage(data, nil, zap.New(zap.UseDevMode(true))); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if handler.arch != "x86_64" {
+				t.Errorf("unexpected architecture %q", handler.arch)
+			}
+			if handler.version != tt.wantVersion {
+				t.Errorf("unexpected version %q, want %q", handler.version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestBuildImageRecreatedHost(t *testing.T) {
+	handler := &fakeImageHandler{}
+	ip := &rhcosImageProvider{
+		ImageHandler: handler,
+		Ignition: newTestTemplate(t, &env.EnvInputs{
+			IronicBaseURL:     "http://ironic.example.com",
+			IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+			InsecureIronicTLS: true,
+		}),
+	}
+	imageData := func(uid types.UID, format metal3.ImageFormat) imageprovider.ImageData {
+		return imageprovider.ImageData{
+			ImageMetadata: &metav1.ObjectMeta{
+				Name:      "host",
+				Namespace: "ns",
+				UID:       uid,
+			},
+			Format:       format,
+			Architecture: "x86_64",
+		}
+	}
+
+	for _, data := range []imageprovider.ImageData{
+		imageData("uid-1", metal3.ImageFormatISO),
+		imageData("uid-1", metal3.ImageFormatInitRD),
+		imageData("uid-1", metal3.ImageFormatISO),
+	} {
+		if _, err := ip.BuildImage(data, nil, zap.New(zap.UseDevMode(true))); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if len(handler.removed) != 0 {
+		t.Fatalf("unexpected removed images %v", handler.removed)
+	}
+
+	if _, err := ip.BuildImage(imageData("uid-2", metal3.ImageFormatISO), nil, zap.New(zap.UseDevMode(true))); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	sort.Strings(handler.removed)
+	wantRemoved := []string{"ns-host-uid-1-x86_64.initrd", "ns-host-uid-1-x86_64.iso"}
+	if !reflect.DeepEqual(handler.removed, wantRemoved) {
+		t.Errorf("unexpected removed images %v, want %v", handler.removed, wantRemoved)
+	}
+	if images := ip.hosts["ns/host"]; images.uid != "uid-2" || len(images.keys) != 1 {
+		t.Errorf("unexpected tracked images %v", images)
+	}
+
+	if err := ip.DiscardImage(imageData("uid-2", metal3.ImageFormatISO)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, ok := ip.hosts["ns/host"]; ok {
+		t.Errorf("host still tracked after its image was discarded")
+	}
+}
+
+func TestBuildImageForceRebuild(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"ironic-python-agent.iso", "ironic-python-agent.initramfs"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputs := &env.EnvInputs{
+		DeployISO:         filepath.Join(dir, "ironic-python-agent.iso"),
+		DeployInitrd:      filepath.Join(dir, "ironic-python-agent.initramfs"),
+		IronicBaseURL:     "http://ironic.example.com",
+		IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+		InsecureIronicTLS: true,
+	}
+	baseURL, _ := url.Parse("http://images.example.com")
+	handler, err := imagehandler.NewImageHandler(zap.New(zap.UseDevMode(true)), baseURL, nil, inputs)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ip := &rhcosImageProvider{ImageHandler: handler, Ignition: newTestTemplate(t, inputs)}
+
+	data := imageprovider.ImageData{
+		ImageMetadata: &metav1.ObjectMeta{
+			Name:        "host",
+			Namespace:   "ns",
+			UID:         "uid-1",
+			Annotations: map[string]string{},
+		},
+		Format:       metal3.ImageFormatISO,
+		Architecture: "x86_64",
+	}
+	build := func() string {
+		t.Helper()
+		image, err := ip.BuildImage(data, nil, zap.New(zap.UseDevMode(true)))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return image.ImageURL
+	}
+
+	url1 := build()
+	data.ImageMetadata.Annotations[imageRebuildAnnotation] = "1"
+	url2 := build()
+	if url2 == url1 {
+		t.Errorf("URL not changed by setting the rebuild annotation")
+	}
+	if url3 := build(); url3 != url2 {
+		t.Errorf("URL changed without a change of the rebuild annotation: %s, was %s", url3, url2)
+	}
+	data.ImageMetadata.Annotations[imageRebuildAnnotation] = "2"
+	url4 := build()
+	if url4 == url2 {
+		t.Errorf("URL not changed by changing the rebuild annotation")
+	}
+	delete(data.ImageMetadata.Annotations, imageRebuildAnnotation)
+	if url5 := build(); url5 != url4 {
+		t.Errorf("URL changed by clearing the rebuild annotation: %s, was %s", url5, url4)
+	}
+}
+
+func TestBuildImageEmptyArchitecture(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"ironic-python-agent.iso", "ironic-python-agent.initramfs"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputs := &env.EnvInputs{
+		DeployISO:         filepath.Join(dir, "ironic-python-agent.iso"),
+		DeployInitrd:      filepath.Join(dir, "ironic-python-agent.initramfs"),
+		IronicBaseURL:     "http://ironic.example.com",
+		IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+		InsecureIronicTLS: true,
+	}
+	baseURL, _ := url.Parse("http://images.example.com")
+	handler, err := imagehandler.NewImageHandler(zap.New(zap.UseDevMode(true)), baseURL, nil, inputs)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ip := &rhcosImageProvider{ImageHandler: handler, Ignition: newTestTemplate(t, inputs)}
+
+	// Hosts that have not been inspected yet report no architecture.
+	if !ip.SupportsArchitecture("") {
+		t.Fatal("expected an empty architecture to be supported")
+	}
+	data := imageprovider.ImageData{
+		ImageMetadata: &metav1.ObjectMeta{Name: "host", Namespace: "ns", UID: "uid-1"},
+		Format:        metal3.ImageFormatISO,
+		Architecture:  "",
+	}
+	image, err := ip.BuildImage(data, nil, zap.New(zap.UseDevMode(true)))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if image.ImageURL == "" {
+		t.Error("no image URL returned")
+	}
+}
+
+func TestBuildImageArchitectureOverride(t *testing.T) {
+	tests := []struct {
+		name        string
+		arch        string
+		annotations map[string]string
+		wantArch    string
+		wantErr     bool
+	}{
+		{
+			name:     "reported",
+			arch:     "x86_64",
+			wantArch: "x86_64",
+		},
+		{
+			name:        "override",
+			arch:        "aarch64",
+			annotations: map[string]string{imageArchitectureAnnotation: "x86_64"},
+			wantArch:    "x86_64",
+		},
+		{
+			name:        "unavailable",
+			arch:        "x86_64",
+			annotations: map[string]string{imageArchitectureAnnotation: "ppc64le"},
+			wantErr:     true,
+		},
+		{
+			name:    "unsupported",
+			arch:    "ppc64le",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &fakeImageHandler{}
+			ip := &rhcosImageProvider{
+				ImageHandler: handler,
+				Ignition: newTestTemplate(t, &env.EnvInputs{
+					IronicBaseURL:     "http://ironic.example.com",
+					IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+					InsecureIronicTLS: true,
+				}),
+			}
+			data := imageprovider.ImageData{
+				ImageMetadata: &metav1.ObjectMeta{
+					Name:        "host",
+					Namespace:   "ns",
+					Annotations: tt.annotations,
+				},
+				Format:       metal3.ImageFormatISO,
+				Architecture: tt.arch,
+			}
+			_, err := ip.BuildImage(data, nil, zap.New(zap.UseDevMode(true)))
+			if tt.wantErr {
+				if !errors.As(err, &imageprovider.ImageBuildInvalid{}) {
+					t.Errorf("expected invalid build error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if handler.arch != tt.wantArch {
+				t.Errorf("unexpected architecture %q, want %q", handler.arch, tt.wantArch)
+			}
+		})
+	}
+}
+
+func TestBuildImageInvalidIgnitionOverride(t *testing.T) {
+	dir := t.TempDir()
+	override := `{"ignition":{"version":"3.2.0"},"storage":{"files":[{"path":"/etc/motd","mode":65535}]}}`
+	if err := os.WriteFile(filepath.Join(dir, "host.ign"), []byte(override), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ip := &rhcosImageProvider{
+		ImageHandler: &fakeImageHandler{},
+		Ignition: newTestTemplate(t, &env.EnvInputs{
+			IronicBaseURL:        "http://ironic.example.com",
+			IronicAgentImage:     "quay.io/openshift-release-dev/ironic-ipa-image",
+			InsecureIronicTLS:    true,
+			IgnitionOverridesDir: dir,
+		}),
+	}
+	data := imageprovider.ImageData{
+		ImageMetadata: &metav1.ObjectMeta{
+			Name:      "host",
+			Namespace: "ns",
+		},
+		Format:       metal3.ImageFormatISO,
+		Architecture: "x86_64",
+	}
+
+	_, err := ip.BuildImage(data, nil, zap.New(zap.UseDevMode(true)))
+	if !errors.As(err, &imageprovider.ImageBuildInvalid{}) {
+		t.Fatalf("expected invalid build error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "mode") {
+		t.Errorf("error does not include the validation report: %v", err)
+	}
+}
+
+func TestNewRHCOSImageProviderError(t *testing.T) {
+	_, err := NewRHCOSImageProvider(context.Background(), &fakeImageHandler{}, &env.EnvInputs{
+		RegistriesConfPath: filepath.Join(t.TempDir(), "missing.conf"),
+	})
+	if err == nil {
+		t.Fatal("expected an error for a missing registries.conf")
+	}
+}
+
+func TestNewRHCOSImageProviderSerialConsoleError(t *testing.T) {
+	_, err := NewRHCOSImageProvider(context.Background(), &fakeImageHandler{}, &env.EnvInputs{
+		IronicBaseURL:     "http://ironic.example.com",
+		IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+		InsecureIronicTLS: true,
+		SerialConsole:     "console=ttyS0",
+	})
+	if err == nil {
+		t.Fatal("expected an error for an invalid serial console")
+	}
+}
+
+func TestBuildImageSerialConsole(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         string
+		annotations map[string]string
+		wantKargs   []string
+		wantErr     bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:      "environment",
+			env:       "console=ttyS0,115200",
+			wantKargs: []string{"console=ttyS0,115200"},
+		},
+		{
+			name:        "annotation",
+			env:         "console=ttyS0,115200",
+			annotations: map[string]string{serialConsoleAnnotation: "console=ttyS1,57600"},
+			wantKargs:   []string{"console=ttyS1,57600"},
+		},
+		{
+			name:        "annotation disables",
+			env:         "console=ttyS0,115200",
+			annotations: map[string]string{serialConsoleAnnotation: ""},
+		},
+		{
+			name:        "invalid annotation",
+			annotations: map[string]string{serialConsoleAnnotation: "console=ttyS1,fast"},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &fakeImageHandler{}
+			inputs := &env.EnvInputs{
+				IronicBaseURL:     "http://ironic.example.com",
+				IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+				InsecureIronicTLS: true,
+				SerialConsole:     tt.env,
+			}
+			provider, err := NewRHCOSImageProvider(context.Background(), handler, inputs)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			_, err = provider.BuildImage(imageprovider.ImageData{
+				ImageMetadata: &metav1.ObjectMeta{
+					Name:        "host",
+					Namespace:   "ns",
+					Annotations: tt.annotations,
+				},
+				Format:       metal3.ImageFormatISO,
+				Architecture: "x86_64",
+			}, nil, zap.New(zap.UseDevMode(true)))
+			if tt.wantErr {
+				if !errors.As(err, &imageprovider.ImageBuildInvalid{}) {
+					t.Errorf("expected an invalid build error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(handler.kargs, tt.wantKargs) {
+				t.Errorf("got kargs %v, want %v", handler.kargs, tt.wantKargs)
+			}
+		})
+	}
+}
+
+func TestBuildImageRequireRegistries(t *testing.T) {
+	tests := []struct {
+		name       string
+		registries string
+		require    bool
+		wantErr    bool
+	}{
+		{
+			name: "not required",
+		},
+		{
+			name:    "required and missing",
+			require: true,
+			wantErr: true,
+		},
+		{
+			name:       "required and blank",
+			registries: "\n  \n",
+			require:    true,
+			wantErr:    true,
+		},
+		{
+			name:       "required and present",
+			registries: "[[registry]]\nlocation = \"quay.io\"\n",
+			require:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputs := &env.EnvInputs{
+				IronicBaseURL:     "http://ironic.example.com",
+				IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+				InsecureIronicTLS: true,
+				RequireRegistries: tt.require,
+			}
+			if tt.registries != "" {
+				inputs.RegistriesConfPath = filepath.Join(t.TempDir(), "registries.conf")
+				if err := os.WriteFile(inputs.RegistriesConfPath, []byte(tt.registries), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ip := &rhcosImageProvider{
+				ImageHandler: &fakeImageHandler{},
+				Ignition:     newTestTemplate(t, inputs),
+			}
+			data := imageprovider.ImageData{
+				ImageMetadata: &metav1.ObjectMeta{
+					Name:      "host",
+					Namespace: "ns",
+				},
+				Format:       metal3.ImageFormatISO,
+				Architecture: "x86_64",
+			}
+
+			_, err := ip.BuildImage(data, nil, zap.New(zap.UseDevMode(true)))
+			if tt.wantErr {
+				if !errors.As(err, &imageprovider.ImageBuildInvalid{}) {
+					t.Errorf("expected invalid build error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestNewRHCOSImageProviderInvalidSettings(t *testing.T) {
+	_, err := NewRHCOSImageProvider(context.Background(), &fakeImageHandler{}, &env.EnvInputs{
+		IronicBaseURL:            "http://ironic.example.com",
+		IronicAgentImage:         "quay.io/openshift-release-dev/ironic-ipa-image",
+		InsecureIronicTLS:        true,
+		IronicAgentRestartPolicy: "sometimes",
+	})
+	if err == nil {
+		t.Fatal("expected an error for an invalid restart policy")
+	}
+}
+
+func TestSupportsArchitecture(t *testing.T) {
+	ip := &rhcosImageProvider{ImageHandler: &fakeImageHandler{}}
+	if !ip.SupportsArchitecture("x86_64") {
+		t.Error("expected x86_64 to be supported")
+	}
+	if ip.SupportsArchitecture("ppc64le") {
+		t.Error("expected ppc64le not to be supported")
+	}
+}
+
+func TestBuildImageInvalidNetworkData(t *testing.T) {
+	// Stand in for nmstatectl, failing with a long multi-line diagnostic.
+	diagnostic := "NmstateError: InvalidArgument: Invalid YAML string: " +
+		"interfaces[0].type: unknown variant `ethernat`\n" +
+		strings.Repeat("detail line\n", 200)
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncat >/dev/null\nprintf '%s' '" + diagnostic + "' >&2\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "nmstatectl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	ip := &rhcosImageProvider{
+		ImageHandler: &fakeImageHandler{},
+		Ignition: newTestTemplate(t, &env.EnvInputs{
+			IronicBaseURL:     "http://ironic.example.com",
+			IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+			InsecureIronicTLS: true,
+		}),
+	}
+	data := imageprovider.ImageData{
+		ImageMetadata: &metav1.ObjectMeta{Name: "host", Namespace: "test"},
+		Format:        metal3.ImageFormatISO,
+		Architecture:  "x86_64",
+	}
+	networkData := imageprovider.NetworkData{
+		"nmstate": []byte("interfaces:\n- name: eth0\n  type: ethernat\n"),
+	}
+
+	_, err := ip.BuildImage(data, networkData, zap.New(zap.UseDevMode(true)))
+	if !errors.As(err, &imageprovider.ImageBuildInvalid{}) {
+		t.Fatalf("expected invalid build error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), diagnostic) {
+		t.Errorf("nmstatectl diagnostic not preserved: %q", err.Error())
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Errorf("nmstatectl exit status not preserved: %v", err)
+	}
+}
+
+func TestBuildImageNMStatectlTimeout(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\nwhile :; do :; done\n"
+	if err := os.WriteFile(filepath.Join(dir, "nmstatectl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	ip := &rhcosImageProvider{
+		ImageHandler: &fakeImageHandler{},
+		Ignition: newTestTemplate(t, &env.EnvInputs{
+			IronicBaseURL:     "http://ironic.example.com",
+			IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+			InsecureIronicTLS: true,
+			NMStatectlTimeout: 100 * time.Millisecond,
+		}),
+	}
+	data := imageprovider.ImageData{
+		ImageMetadata: &metav1.ObjectMeta{Name: "host", Namespace: "test"},
+		Format:        metal3.ImageFormatISO,
+		Architecture:  "x86_64",
+	}
+	networkData := imageprovider.NetworkData{
+		"nmstate": []byte("interfaces:\n- name: eth1\n  type: ethernet\n"),
+	}
+
+	_, err := ip.BuildImage(data, networkData, zap.New(zap.UseDevMode(true)))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestBuildImageCanceled(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\nwhile :; do :; done\n"
+	if err := os.WriteFile(filepath.Join(dir, "nmstatectl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ip := &rhcosImageProvider{
+		ctx:          ctx,
+		ImageHandler: &fakeImageHandler{},
+		Ignition: newTestTemplate(t, &env.EnvInputs{
+			IronicBaseURL:     "http://ironic.example.com",
+			IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+			InsecureIronicTLS: true,
+			NMStatectlTimeout: time.Minute,
+		}),
+	}
+	data := imageprovider.ImageData{
+		ImageMetadata: &metav1.ObjectMeta{Name: "host", Namespace: "test"},
+		Format:        metal3.ImageFormatISO,
+		Architecture:  "x86_64",
+	}
+	networkData := imageprovider.NetworkData{
+		"nmstate": []byte("interfaces:\n- name: eth2\n  type: ethernet\n"),
+	}
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := ip.BuildImage(data, networkData, zap.New(zap.UseDevMode(true)))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("build not aborted promptly, took %s", elapsed)
+	}
+}
+
+type fakeReader struct {
+	objects map[types.NamespacedName]client.Object
+}
+
+func (r *fakeReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	stored, exists := r.objects[key]
+	if !exists {
+		return k8serrors.NewNotFound(schema.GroupResource{}, key.Name)
+	}
+	switch o := obj.(type) {
+	case *metal3.PreprovisioningImage:
+		*o = *stored.(*metal3.PreprovisioningImage)
+	case *corev1.Secret:
+		*o = *stored.(*corev1.Secret)
+	}
+	return nil
+}
+
+func (r *fakeReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return nil
+}
+
+func TestDebugIgnitionHandler(t *testing.T) {
+	ip := &rhcosImageProvider{
+		ImageHandler: &fakeImageHandler{},
+		Ignition: newTestTemplate(t, &env.EnvInputs{
+			IronicBaseURL:     "http://ironic.example.com",
+			IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+			InsecureIronicTLS: true,
+		}),
+	}
+	reader := &fakeReader{objects: map[types.NamespacedName]client.Object{
+		{Namespace: "test", Name: "host"}: &metal3.PreprovisioningImage{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "host"},
+			Spec:       metal3.PreprovisioningImageSpec{Architecture: "aarch64"},
+		},
+		{Namespace: "test", Name: "overridden"}: &metal3.PreprovisioningImage{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        "overridden",
+				Annotations: map[string]string{imageArchitectureAnnotation: "x86_64"},
+			},
+			Spec: metal3.PreprovisioningImageSpec{Architecture: "aarch64"},
+		},
+		{Namespace: "test", Name: "broken"}: &metal3.PreprovisioningImage{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "broken"},
+			Spec:       metal3.PreprovisioningImageSpec{NetworkDataName: "missing"},
+		},
+	}}
+	handler := DebugIgnitionHandler(ip, reader)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		want       string
+		wantNot    string
+	}{
+		{path: "/debug/ignition/test/host", wantStatus: http.StatusOK, want: "--arch=arm64"},
+		{path: "/debug/ignition/test/overridden", wantStatus: http.StatusOK, want: "ironic-agent", wantNot: "--arch=arm64"},
+		{path: "/debug/ignition/test/other", wantStatus: http.StatusNotFound},
+		{path: "/debug/ignition/test/broken", wantStatus: http.StatusNotFound},
+		{path: "/debug/ignition/test", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body.String())
+			}
+			if tt.want == "" {
+				return
+			}
+			if rr.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("unexpected content type %s", rr.Header().Get("Content-Type"))
+			}
+			if !strings.Contains(rr.Body.String(), tt.want) {
+				t.Errorf("expected %q in ignition %s", tt.want, rr.Body.String())
+			}
+			if tt.wantNot != "" && strings.Contains(rr.Body.String(), tt.wantNot) {
+				t.Errorf("unexpected %q in ignition %s", tt.wantNot, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestBuildImageLogging(t *testing.T) {
+	ip := &rhcosImageProvider{
+		ImageHandler: &fakeImageHandler{},
+		Ignition: newTestTemplate(t, &env.EnvInputs{
+			IronicBaseURL:     "http://ironic.example.com",
+			IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+			InsecureIronicTLS: true,
+		}),
+	}
+	data := imageprovider.ImageData{
+		ImageMetadata: &metav1.ObjectMeta{
+			Name:      "host",
+			Namespace: "ns",
+			UID:       "1234",
+		},
+		Format:       metal3.ImageFormatInitRD,
+		Architecture: "aarch64",
+	}
+
+	var logs bytes.Buffer
+	if _, err := ip.BuildImage(data, nil, zap.New(zap.WriteTo(&logs))); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, field := range []string{
+		`"msg":"built image for host"`,
+		`"host":"ns/host"`,
+		`"uid":"1234"`,
+		`"arch":"aarch64"`,
+		`"format":"initrd"`,
+		`"url":"http://example.com/ns-host-1234-aarch64.initrd"`,
+	} {
+		if !strings.Contains(logs.String(), field) {
+			t.Errorf("expected %s in log %s", field, logs.String())
+		}
+	}
+}
+
+// fakeClient is a client.Client storing objects in a fakeReader, with just
+// enough of the interface for the PreprovisioningImage reconciler.
+type fakeClient struct {
+	client.Client
+	reader *fakeReader
+}
+
+func (c *fakeClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	return c.reader.Get(ctx, key, obj, opts...)
+}
+
+func (c *fakeClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.reader.objects[client.ObjectKeyFromObject(obj)] = obj.DeepCopyObject().(client.Object)
+	return nil
+}
+
+func (c *fakeClient) Status() client.SubResourceWriter {
+	return &fakeStatusWriter{client: c}
+}
+
+type fakeStatusWriter struct {
+	client.SubResourceWriter
+	client *fakeClient
+}
+
+func (w *fakeStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+	return w.client.Update(ctx, obj)
+}
+
+func TestReconcileArchitectureOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		arch     string
+		wantArch string
+	}{
+		{
+			name:     "override",
+			arch:     "aarch64",
+			wantArch: "x86_64",
+		},
+		{
+			// The reconciler checks the reported architecture before
+			// building, so the annotation cannot rescue it.
+			name: "unsupported overridden",
+			arch: "ppc64le",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := types.NamespacedName{Namespace: "test", Name: "host"}
+			reader := &fakeReader{objects: map[types.NamespacedName]client.Object{
+				key: &metal3.PreprovisioningImage{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   key.Namespace,
+						Name:        key.Name,
+						Annotations: map[string]string{imageArchitectureAnnotation: "x86_64"},
+					},
+					Spec: metal3.PreprovisioningImageSpec{
+						Architecture:  tt.arch,
+						AcceptFormats: []metal3.ImageFormat{metal3.ImageFormatISO},
+					},
+				},
+			}}
+			handler := &fakeImageHandler{}
+			reconciler := &metal3iocontroller.PreprovisioningImageReconciler{
+				Client:    &fakeClient{reader: reader},
+				Log:       zap.New(zap.UseDevMode(true)),
+				APIReader: reader,
+				ImageProvider: &rhcosImageProvider{
+					ImageHandler: handler,
+					Ignition: newTestTemplate(t, &env.EnvInputs{
+						IronicBaseURL:     "http://ironic.example.com",
+						IronicAgentImage:  "quay.io/openshift-release-dev/ironic-ipa-image",
+						InsecureIronicTLS: true,
+					}),
+				},
+			}
+
+			// Adding the finalizer, recording the configuration and building
+			// the image each take a reconcile.
+			for i := 0; i < 3; i++ {
+				if _, err := reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: key}); err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+			}
+
+			img := reader.objects[key].(*metal3.PreprovisioningImage)
+			if tt.wantArch == "" {
+				if img.Status.ImageUrl != "" {
+					t.Errorf("unexpected image %s", img.Status.ImageUrl)
+				}
+				return
+			}
+			if img.Status.ImageUrl == "" {
+				t.Fatalf("no image built, conditions %v", img.Status.Conditions)
+			}
+			if handler.arch != tt.wantArch {
+				t.Errorf("unexpected architecture %q, want %q", handler.arch, tt.wantArch)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+// Package logging configures the logs of the controller and static server.
+package logging
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+const (
+	// FormatJSON writes each log entry as a JSON object, for ingestion by
+	// log pipelines.
+	FormatJSON = "json"
+	// FormatConsole writes human-readable log entries.
+	FormatConsole = "console"
+)
+
+// Options returns the zap options for a logger in development mode or not,
+// writing in the given format. An empty format selects console output in
+// development mode, and JSON otherwise.
+func Options(devLogging bool, format string) ([]zap.Opts, error) {
+	opts := []zap.Opts{zap.UseDevMode(devLogging)}
+	switch format {
+	case "":
+	case FormatJSON:
+		opts = append(opts, zap.JSONEncoder())
+	case FormatConsole:
+		opts = append(opts, zap.ConsoleEncoder())
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected %s or %s", format, FormatJSON, FormatConsole)
+	}
+	return opts, nil
+}
@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func TestOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		devLogging bool
+		format     string
+		wantJSON   bool
+		wantErr    bool
+	}{
+		{name: "default", wantJSON: true},
+		{name: "dev default", devLogging: true},
+		{name: "json", format: FormatJSON, wantJSON: true},
+		{name: "dev json", devLogging: true, format: FormatJSON, wantJSON: true},
+		{name: "console", format: FormatConsole},
+		{name: "invalid", format: "xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := Options(tt.devLogging, tt.format)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			var out bytes.Buffer
+			zap.New(append(opts, zap.WriteTo(&out))...).Info("hello", "key", "value")
+			var entry map[string]interface{}
+			isJSON := json.Unmarshal(out.Bytes(), &entry) == nil
+			if isJSON != tt.wantJSON {
+				t.Errorf("got JSON %t, want %t: %s", isJSON, tt.wantJSON, out.String())
+			}
+			if isJSON && entry["key"] != "value" {
+				t.Errorf("unexpected log entry %s", out.String())
+			}
+		})
+	}
+}
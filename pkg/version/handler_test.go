@@ -0,0 +1,31 @@
+package version
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+
+	info := Info{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if info.Version != Raw || info.Commit != Commit || info.GoVersion != runtime.Version() {
+		t.Errorf("unexpected version info %+v", info)
+	}
+
+	rr = httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/version", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status %d for POST", rr.Code)
+	}
+}